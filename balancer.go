@@ -0,0 +1,277 @@
+package drpc
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Address is a server a Balancer may send calls to.
+type Address struct {
+	Addr string
+	// Weight is the share of the calls the server takes under the Weighted
+	// policy, relative to the other servers. Zero counts as one.
+	Weight int
+}
+
+// Backend is a server of a Balancer, as seen by a Policy.
+type Backend struct {
+	Address
+	conn *clientConn
+}
+
+// Pending returns the number of calls and streams in flight on b.
+func (b *Backend) Pending() int {
+	return int(b.conn.load())
+}
+
+// weight returns the weight of b, counting zero as one.
+func (b *Backend) weight() int {
+	if b.Weight < 1 {
+		return 1
+	}
+	return b.Weight
+}
+
+// Balancer spreads calls over several servers. Each backend is a
+// ReconnectingClient, and only backends that are connected are in rotation:
+// a backend whose connection breaks, or whose dials fail, is skipped until a
+// dial succeeds again. Among those, the Policy picks the backend of each call.
+//
+// While no backend is connected, calls wait for one as long as a backend is
+// connecting. Once all dials failed, or if there are no backends at all, they
+// fail with ErrUnavailable unless WithWaitForReady was given.
+type Balancer struct {
+	dial         func(addr string) (*Client, error)
+	opts         []DialOption
+	policy       Policy
+	waitForReady bool
+	stopResolver context.CancelFunc // set by DialTarget
+
+	mu       sync.Mutex // protects following
+	backends []*Backend // sorted by Addr
+	closed   bool
+	changed  chan struct{} // closed and replaced when a backend changes
+}
+
+// DialBalancer returns a Balancer over addrs that dials each with Dial and
+// opts. Like DialReconnecting, it dials in the background.
+func DialBalancer(network string, addrs []Address, opts ...DialOption) *Balancer {
+	return NewBalancer(func(addr string) (*Client, error) {
+		return Dial(network, addr, opts...)
+	}, addrs, opts...)
+}
+
+// NewBalancer returns a Balancer over addrs that connects to each with dial.
+// opts configure the backends like they do for NewReconnectingClient, and
+// WithBalancerPolicy picks the policy, RoundRobin by default.
+func NewBalancer(dial func(addr string) (*Client, error), addrs []Address, opts ...DialOption) *Balancer {
+	o := defaultDialOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	b := &Balancer{
+		dial:         dial,
+		opts:         opts,
+		policy:       o.policy,
+		waitForReady: o.waitForReady,
+		changed:      make(chan struct{}),
+	}
+	if b.policy == nil {
+		b.policy = RoundRobin()
+	}
+	b.UpdateAddresses(addrs)
+	return b
+}
+
+// UpdateAddresses replaces the servers of b by addrs. Backends that are still
+// in addrs keep their connection; the others are closed once their calls
+// completed.
+func (b *Balancer) UpdateAddresses(addrs []Address) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+
+	old := make(map[string]*Backend, len(b.backends))
+	for _, be := range b.backends {
+		old[be.Addr] = be
+	}
+	backends := make([]*Backend, 0, len(addrs))
+	seen := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		if seen[addr.Addr] {
+			continue
+		}
+		seen[addr.Addr] = true
+		var conn *clientConn
+		if be, ok := old[addr.Addr]; ok {
+			conn = be.conn
+			delete(old, addr.Addr)
+		} else {
+			conn = &clientConn{client: b.connect(addr.Addr)}
+			go b.watch(conn.client)
+		}
+		backends = append(backends, &Backend{Address: addr, conn: conn})
+	}
+	sort.Slice(backends, func(i, j int) bool {
+		return backends[i].Addr < backends[j].Addr
+	})
+	for _, be := range old {
+		go retire(be.conn)
+	}
+	b.backends = backends
+	b.notifyLocked()
+}
+
+func (b *Balancer) connect(addr string) *ReconnectingClient {
+	return NewReconnectingClient(func() (*Client, error) {
+		return b.dial(addr)
+	}, b.opts...)
+}
+
+// retire closes conn once nothing is in flight on it anymore.
+func retire(conn *clientConn) {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for conn.load() > 0 {
+		<-ticker.C
+	}
+	conn.client.Close()
+}
+
+// watch tells the callers waiting in pick about the state changes of client.
+func (b *Balancer) watch(client *ReconnectingClient) {
+	for state := client.State(); state != StateShutdown; state = client.State() {
+		client.WaitForStateChange(context.Background(), state)
+		b.mu.Lock()
+		b.notifyLocked()
+		b.mu.Unlock()
+	}
+}
+
+func (b *Balancer) notifyLocked() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// pick returns the backend for the call info describes, waiting for one to
+// connect as the policy of b says.
+func (b *Balancer) pick(info PickInfo) (*Backend, error) {
+	for {
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			return nil, ErrShutdown
+		}
+		var ready []*Backend
+		connecting := false
+		for _, be := range b.backends {
+			switch be.conn.client.State() {
+			case StateReady:
+				ready = append(ready, be)
+			case StateConnecting:
+				connecting = true
+			}
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		if len(ready) > 0 {
+			if be := b.policy.Pick(info, ready); be != nil {
+				return be, nil
+			}
+		}
+		if !connecting && !b.waitForReady {
+			return nil, ErrUnavailable
+		}
+		select {
+		case <-changed:
+		case <-info.Ctx.Done():
+			return nil, info.Ctx.Err()
+		}
+	}
+}
+
+// States returns the connectivity state of each backend by address.
+func (b *Balancer) States() map[string]ConnState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	states := make(map[string]ConnState, len(b.backends))
+	for _, be := range b.backends {
+		states[be.Addr] = be.conn.client.State()
+	}
+	return states
+}
+
+func (b *Balancer) Call(serviceMethod string, args, reply Serializer) error {
+	return b.CallContext(context.Background(), serviceMethod, args, reply)
+}
+
+// CallContext is like Client.CallContext, over a backend picked by the
+// policy.
+func (b *Balancer) CallContext(ctx context.Context, serviceMethod string, args, reply Serializer) error {
+	call := <-b.GoContext(ctx, serviceMethod, args, reply).Done
+	return call.Error
+}
+
+func (b *Balancer) Go(serviceMethod string, args, reply Serializer) *Call {
+	return b.GoContext(context.Background(), serviceMethod, args, reply)
+}
+
+// GoContext is like Client.GoContext, over a backend picked by the policy.
+func (b *Balancer) GoContext(ctx context.Context, serviceMethod string, args, reply Serializer) *Call {
+	call := NewCall(serviceMethod, args, reply)
+	call.ctx = ctx
+	go func() {
+		be, err := b.pick(PickInfo{Ctx: ctx, ServiceMethod: serviceMethod, Args: args})
+		if err != nil {
+			call.Error = err
+		} else {
+			be.conn.invoke(call)
+		}
+		call.done()
+	}()
+	return call
+}
+
+// CallStream is like Client.CallStream, over a backend picked by the policy.
+func (b *Balancer) CallStream(ctx context.Context, serviceMethod string, args Serializer) (*ClientStream, error) {
+	be, err := b.pick(PickInfo{Ctx: ctx, ServiceMethod: serviceMethod, Args: args})
+	if err != nil {
+		return nil, err
+	}
+	return be.conn.track(be.conn.client.CallStream(ctx, serviceMethod, args))
+}
+
+// NewStream is like Client.NewStream, over a backend picked by the policy.
+// The policy sees no Args.
+func (b *Balancer) NewStream(ctx context.Context, serviceMethod string) (*ClientStream, error) {
+	be, err := b.pick(PickInfo{Ctx: ctx, ServiceMethod: serviceMethod})
+	if err != nil {
+		return nil, err
+	}
+	return be.conn.track(be.conn.client.NewStream(ctx, serviceMethod))
+}
+
+// Close closes all backends. Calls waiting for a backend fail with
+// ErrShutdown.
+func (b *Balancer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrShutdown
+	}
+	b.closed = true
+	if b.stopResolver != nil {
+		b.stopResolver()
+	}
+	for _, be := range b.backends {
+		be.conn.client.Close()
+	}
+	b.backends = nil
+	b.notifyLocked()
+	return nil
+}
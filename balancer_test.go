@@ -0,0 +1,132 @@
+package drpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startNamedServer starts a server whose "Name.Get" method replies with name.
+func startNamedServer(t *testing.T, name string) (addr string, server *Server) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = NewServer()
+	RegisterService(server, "Name.Get", func(req []byte) ([]byte, error) {
+		return []byte(name), nil
+	})
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return listener.Addr().String(), server
+}
+
+func getName(t *testing.T, b *Balancer) string {
+	reply := new(rawArgs)
+	assert.NoError(t, b.Call("Name.Get", new(rawArgs), reply))
+	return string(*reply)
+}
+
+// waitForBalancer waits until the backends at addrs are in the given state.
+func waitForBalancer(t *testing.T, b *Balancer, state ConnState, addrs ...string) {
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		states := b.States()
+		done := true
+		for _, addr := range addrs {
+			done = done && states[addr] == state
+		}
+		if done {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("backends are %v, want %v", states, state)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBalancer(t *testing.T) {
+	a, _ := startNamedServer(t, "a")
+	b, _ := startNamedServer(t, "b")
+	c, _ := startNamedServer(t, "c")
+	balancer := DialBalancer("tcp", []Address{{Addr: a}, {Addr: b}, {Addr: c}})
+	defer balancer.Close()
+	waitForBalancer(t, balancer, StateReady, a, b, c)
+
+	counts := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		counts[getName(t, balancer)]++
+	}
+	assert.Equal(t, map[string]int{"a": 2, "b": 2, "c": 2}, counts)
+}
+
+func TestBalancerWeighted(t *testing.T) {
+	a, _ := startNamedServer(t, "a")
+	b, _ := startNamedServer(t, "b")
+	balancer := DialBalancer("tcp", []Address{{Addr: a, Weight: 3}, {Addr: b}}, WithBalancerPolicy(Weighted()))
+	defer balancer.Close()
+	waitForBalancer(t, balancer, StateReady, a, b)
+
+	counts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		counts[getName(t, balancer)]++
+	}
+	assert.Equal(t, map[string]int{"a": 6, "b": 2}, counts)
+}
+
+func TestBalancerSkipsFailedBackend(t *testing.T) {
+	a, server := startNamedServer(t, "a")
+	b, _ := startNamedServer(t, "b")
+	balancer := DialBalancer("tcp", []Address{{Addr: a}, {Addr: b}},
+		WithBackoff(testBackoff), WithBalancerPolicy(PowerOfTwoChoices()))
+	defer balancer.Close()
+	waitForBalancer(t, balancer, StateReady, a, b)
+
+	server.Close()
+	waitForBalancer(t, balancer, StateTransientFailure, a)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "b", getName(t, balancer))
+	}
+}
+
+func TestBalancerUpdateAddresses(t *testing.T) {
+	a, _ := startNamedServer(t, "a")
+	b, _ := startNamedServer(t, "b")
+	balancer := DialBalancer("tcp", []Address{{Addr: a}})
+	defer balancer.Close()
+	assert.Equal(t, "a", getName(t, balancer))
+
+	balancer.mu.Lock()
+	old := balancer.backends[0].conn.client
+	balancer.mu.Unlock()
+	balancer.UpdateAddresses([]Address{{Addr: b}})
+	assert.Equal(t, "b", getName(t, balancer))
+	assert.Equal(t, map[string]ConnState{b: StateReady}, balancer.States())
+	waitForState(t, old, StateShutdown)
+}
+
+func TestBalancerUnavailable(t *testing.T) {
+	balancer := DialBalancer("tcp", nil)
+	assert.Equal(t, ErrUnavailable, balancer.Call("Name.Get", new(rawArgs), new(rawArgs)))
+
+	// With WithWaitForReady the call waits for a backend to show up.
+	waiting := DialBalancer("tcp", nil, WithWaitForReady(true))
+	call := waiting.Go("Name.Get", new(rawArgs), new(rawArgs))
+	a, _ := startNamedServer(t, "a")
+	waiting.UpdateAddresses([]Address{{Addr: a}})
+	select {
+	case <-call.Done:
+		assert.NoError(t, call.Error)
+		assert.Equal(t, "a", string(*call.Reply.(*rawArgs)))
+	case <-time.After(2 * time.Second):
+		t.Fatal("call didn't complete")
+	}
+
+	assert.NoError(t, waiting.Close())
+	assert.NoError(t, balancer.Close())
+	_, err := balancer.NewStream(context.Background(), "Name.Get")
+	assert.Equal(t, ErrShutdown, err)
+}
@@ -2,13 +2,14 @@ package drpc
 
 import (
 	"bufio"
-	"errors"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"hash/crc32"
 	"io"
-	"log"
 	"net"
 	"sync"
+	"time"
 )
 
 var _ ClientCodec = (*clientCodec)(nil)
@@ -22,8 +23,13 @@ type Call struct {
 	ServiceMethod string
 	Args          Serializer
 	Reply         Serializer
+	Metadata      Metadata // metadata of the response
 	Error         error
 	Done          chan *Call
+
+	ctx      context.Context
+	seq      uint64
+	finished chan struct{} // closed once the call completes
 }
 
 func NewCall(serviceMethod string, args Serializer, reply Serializer) *Call {
@@ -32,44 +38,163 @@ func NewCall(serviceMethod string, args Serializer, reply Serializer) *Call {
 		Args:          args,
 		Reply:         reply,
 		Done:          make(chan *Call, 1),
+		ctx:           context.Background(),
+		finished:      make(chan struct{}),
 	}
 }
 
+// done must be called exactly once, by whoever removed the call from
+// Client.pending (or never registered it).
 func (call *Call) done() {
+	if call.finished != nil {
+		close(call.finished)
+	}
 	call.Done <- call
 }
 
 type Client struct {
-	codec   ClientCodec
-	sending sync.Mutex // guards the sending
+	codec        ClientCodec
+	limits       Limits
+	interceptors []UnaryClientInterceptor
+	logger       Logger
+	sending      sync.Mutex // guards the sending
+	window       *sendWindow
+	credit       *recvWindow
+	partial      map[uint64]*partialResponse // used by receive only
+	done         chan struct{}               // closed once receive returned
 
 	mu       sync.Mutex // protects following
 	seq      uint64
 	shutdown bool
 	closing  bool
 	pending  map[uint64]*Call
+	streams  map[uint64]*ClientStream
 }
 
-func NewClient(conn io.ReadWriteCloser) *Client {
+// NewClient returns a client that makes calls over conn, configured by opts.
+func NewClient(conn io.ReadWriteCloser, opts ...DialOption) *Client {
+	o := defaultDialOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	var codec ClientCodec = newClientCodec(conn, o.limits)
+	if o.codec != nil {
+		codec = o.codec(conn)
+	}
 	client := &Client{
-		codec:   NewClientCodec(conn),
-		pending: make(map[uint64]*Call),
+		codec:        codec,
+		limits:       o.limits,
+		window:       newSendWindow(),
+		credit:       newRecvWindow(),
+		partial:      make(map[uint64]*partialResponse),
+		pending:      make(map[uint64]*Call),
+		streams:      make(map[uint64]*ClientStream),
+		done:         make(chan struct{}),
+		interceptors: o.interceptors,
+		logger:       o.logger,
 	}
 	go client.receive()
 	return client
 }
 
 func (c *Client) Call(serviceMethod string, args, reply Serializer) error {
-	call := <-c.Go(serviceMethod, args, reply).Done
+	return c.CallContext(context.Background(), serviceMethod, args, reply)
+}
+
+// CallContext is like Call, but stops waiting once ctx is cancelled or its
+// deadline passes, returning ctx.Err().
+func (c *Client) CallContext(ctx context.Context, serviceMethod string, args, reply Serializer) error {
+	call := <-c.GoContext(ctx, serviceMethod, args, reply).Done
 	return call.Error
 }
 
 func (c *Client) Go(serviceMethod string, args, reply Serializer) *Call {
+	return c.GoContext(context.Background(), serviceMethod, args, reply)
+}
+
+// GoContext is like Go, but if ctx is done before the response arrives the
+// call is removed from the pending set, the server is told to cancel it, and
+// it completes with ctx.Err(). A response that arrives afterwards is
+// discarded. The deadline of ctx, if any, is sent along with the request.
+func (c *Client) GoContext(ctx context.Context, serviceMethod string, args, reply Serializer) *Call {
+	if len(c.interceptors) == 0 {
+		return c.start(ctx, serviceMethod, args, reply)
+	}
+
+	// The interceptors may block, e.g. to retry, so run them on their own
+	// goroutine and complete call once the outermost one returns.
 	call := NewCall(serviceMethod, args, reply)
+	call.ctx = ctx
+	go func() {
+		// Capture the response metadata of the last attempt into call.
+		md, ok := ctx.Value(capturedMetadataKey{}).(*Metadata)
+		if !ok {
+			md = new(Metadata)
+			ctx = CaptureResponseMetadata(ctx, md)
+		}
+		invoker := chainUnaryClient(c.interceptors, c.invoke)
+		call.Error = invoker(ctx, serviceMethod, args, reply)
+		call.Metadata = *md
+		call.done()
+	}()
+	return call
+}
+
+// invoke sends one request and waits for its response. It is the innermost
+// UnaryInvoker of the interceptor chain.
+func (c *Client) invoke(ctx context.Context, serviceMethod string, args, reply Serializer) error {
+	call := <-c.start(ctx, serviceMethod, args, reply).Done
+	return call.Error
+}
+
+// start sends a request without going through the interceptors.
+func (c *Client) start(ctx context.Context, serviceMethod string, args, reply Serializer) *Call {
+	call := NewCall(serviceMethod, args, reply)
+	call.ctx = ctx
+	if err := ctx.Err(); err != nil {
+		call.Error = err
+		call.done()
+		return call
+	}
+
 	c.send(call)
+	if ctx.Done() != nil {
+		go c.watch(ctx, call)
+	}
 	return call
 }
 
+// watch abandons call when ctx is done before the call completes.
+func (c *Client) watch(ctx context.Context, call *Call) {
+	select {
+	case <-ctx.Done():
+		if c.takeCall(call.seq) != nil {
+			call.Error = ctx.Err()
+			call.done()
+			c.sendCancel(call.seq)
+		}
+	case <-call.finished:
+	}
+}
+
+// sendCancel tells the server to stop working on the call with the given seq.
+func (c *Client) sendCancel(seq uint64) {
+	c.sending.Lock()
+	defer c.sending.Unlock()
+
+	if c.isShutdown() {
+		return
+	}
+	req := &RequestHeader{
+		Type:     RequestCancel,
+		ID:       seq,
+		Checksum: crc32.ChecksumIEEE(nil),
+	}
+	if err := c.writeRequest(req, nil); err != nil {
+		c.logger.Log(LevelDebug, "rpc:failed to write cancel request", "id", seq, "err", err)
+	}
+}
+
 func (c *Client) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -80,13 +205,19 @@ func (c *Client) Close() error {
 	return c.codec.Close()
 }
 
+func (c *Client) isShutdown() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.shutdown || c.closing
+}
+
 func (c *Client) getSeq() uint64 {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	seq := c.seq
+	// IDs start at 1, connWindowID is reserved.
 	c.seq++
-	return seq
+	return c.seq
 }
 
 func (c *Client) registerCall(seq uint64, call *Call) {
@@ -95,54 +226,226 @@ func (c *Client) registerCall(seq uint64, call *Call) {
 	c.pending[seq] = call
 }
 
-func (c *Client) getCall(seq uint64) *Call {
+func (c *Client) registerStream(s *ClientStream) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return c.pending[seq]
+	c.streams[s.id] = s
 }
 
-func (c *Client) removeCall(seq uint64) {
+// takeStream removes the stream registered under seq and returns it, or nil
+// if it has already ended.
+func (c *Client) takeStream(seq uint64) *ClientStream {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	delete(c.pending, seq)
+	s := c.streams[seq]
+	delete(c.streams, seq)
+	return s
 }
 
-func (c *Client) send(call *Call) {
-	var err error
+func (c *Client) getStream(seq uint64) *ClientStream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.streams[seq]
+}
 
-	c.sending.Lock()
-	defer func() {
-		c.sending.Unlock()
-		if err != nil {
-			call.done()
-		}
-	}()
+// requestTimeout returns the Timeout to send for a request made with ctx.
+func requestTimeout(ctx context.Context) (time.Duration, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, nil
+	}
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return 0, context.DeadlineExceeded
+	}
+	return timeout, nil
+}
 
-	if c.shutdown || c.closing {
+// takeCall removes the call registered under seq and returns it, or nil if
+// it has already been completed by someone else.
+func (c *Client) takeCall(seq uint64) *Call {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	call := c.pending[seq]
+	delete(c.pending, seq)
+	return call
+}
+
+func (c *Client) send(call *Call) {
+	if c.isShutdown() {
 		call.Error = ErrShutdown
-		err = ErrShutdown
+		call.done()
+		return
+	}
+	timeout, err := requestTimeout(call.ctx)
+	if err != nil {
+		call.Error = err
+		call.done()
+		return
+	}
+	body, err := call.Args.Marshal()
+	if err != nil {
+		call.Error = err
+		call.done()
 		return
 	}
 
 	req := &RequestHeader{
-		ID:     c.getSeq(),
-		Method: call.ServiceMethod,
+		Type:     RequestCall,
+		ID:       c.getSeq(),
+		Method:   call.ServiceMethod,
+		Timeout:  timeout,
+		Metadata: OutgoingMetadata(call.ctx),
 	}
+	call.seq = req.ID
+	c.window.open(req.ID)
+	defer c.window.forget(req.ID)
+	c.credit.open(req.ID)
 	c.registerCall(req.ID, call)
 
-	body, err := call.Args.Marshal()
+	written, err := c.writeMessage(call.ctx, req, body)
 	if err != nil {
-		call.Error = err
-		c.removeCall(req.ID)
+		c.logger.Log(LevelDebug, "rpc:failed to write request", "method", call.ServiceMethod, "err", err)
+		if c.takeCall(req.ID) != nil {
+			call.Error = err
+			call.done()
+		}
+		c.credit.forget(req.ID)
+		if written {
+			// The server holds part of the body, tell it to drop it.
+			c.sendCancel(req.ID)
+		}
+	}
+}
+
+// writeMessage writes req followed by body, split into fragments of at most
+// MaxFragmentSize as far as the send window allows. The sending lock is only
+// held per fragment, so other calls can send in between. It reports whether
+// any frame was written.
+func (c *Client) writeMessage(ctx context.Context, req *RequestHeader, body []byte) (bool, error) {
+	written := false
+	for {
+		size := len(body)
+		if size > MaxFragmentSize {
+			size = MaxFragmentSize
+		}
+		n, err := c.window.reserve(ctx, req.ID, size)
+		if err != nil {
+			return written, err
+		}
+		fragment := body[:n]
+		body = body[n:]
+		if len(body) > 0 {
+			req.Flags |= FlagMore
+		} else {
+			req.Flags &^= FlagMore
+		}
+		req.Checksum = crc32.ChecksumIEEE(fragment)
+
+		c.sending.Lock()
+		if c.isShutdown() {
+			c.sending.Unlock()
+			return written, ErrShutdown
+		}
+		err = c.writeRequest(req, fragment)
+		c.sending.Unlock()
+		if err != nil {
+			return written, err
+		}
+		written = true
+
+		if len(body) == 0 {
+			return written, nil
+		}
+		req = &RequestHeader{
+			Type: RequestContinuation,
+			ID:   req.ID,
+		}
+	}
+}
+
+// openWindows starts flow control for the stream with the given id.
+func (c *Client) openWindows(id uint64) {
+	c.window.open(id)
+	c.credit.open(id)
+}
+
+func (c *Client) forgetWindows(id uint64) {
+	c.window.forget(id)
+	c.credit.forget(id)
+}
+
+// consumed returns the credit for n bytes of the response with the given
+// id once they were consumed.
+func (c *Client) consumed(id uint64, n int) {
+	c.returnCredit(c.credit.consumed(id, n))
+}
+
+// returnCredit sends updates to the server. It doesn't wait for the
+// sending lock, as it is called by receive.
+func (c *Client) returnCredit(updates []windowUpdate) {
+	if len(updates) > 0 {
+		go c.sendWindowUpdates(updates)
+	}
+}
+
+func (c *Client) sendWindowUpdates(updates []windowUpdate) {
+	c.sending.Lock()
+	defer c.sending.Unlock()
+
+	if c.isShutdown() {
 		return
 	}
-	req.Checksum = crc32.ChecksumIEEE(body)
+	for _, u := range updates {
+		body := encodeWindowUpdate(u.n)
+		req := &RequestHeader{
+			Type:     RequestWindowUpdate,
+			ID:       u.id,
+			Checksum: crc32.ChecksumIEEE(body),
+		}
+		if err := c.writeRequest(req, body); err != nil {
+			c.logger.Log(LevelDebug, "rpc:failed to write window update", "err", err)
+			return
+		}
+	}
+}
 
-	if err := c.writeRequest(req, body); err != nil {
-		log.Println("rpc:failed to write request, err:", err)
-		call.Error = err
-		c.removeCall(c.seq)
+// partialResponse is a response whose body is still arriving in fragments.
+type partialResponse struct {
+	header *ResponseHeader
+	body   []byte
+	err    error // set if the body exceeds MaxBodySize; the body is dropped
+}
+
+// assemble collects the fragments of response bodies. It returns the header
+// of the first fragment with the whole body once the last fragment arrived,
+// and a nil header before then. The error is set if the body exceeds
+// MaxBodySize. A response that isn't a continuation replaces any unfinished
+// one with the same ID.
+func (c *Client) assemble(resp *ResponseHeader, data []byte) (*ResponseHeader, []byte, error) {
+	p := c.partial[resp.ID]
+	if resp.Type != ResponseContinuation {
+		p = &partialResponse{header: resp}
+	} else if p == nil {
+		// The rest of a response the server gave up on.
+		return nil, nil, nil
+	}
+	if size := len(p.body) + len(data); p.err == nil && size > c.limits.MaxBodySize {
+		p.err = errTooLarge("response", uint64(size), c.limits.MaxBodySize)
+		p.body = nil
+	} else if p.err == nil {
+		p.body = append(p.body, data...)
+	}
+
+	if resp.Flags&FlagMore != 0 {
+		c.partial[resp.ID] = p
+		// The body must arrive whole before it can be consumed, so the
+		// fragments before the last are consumed right away.
+		c.consumed(resp.ID, len(data))
+		return nil, nil, nil
 	}
+	delete(c.partial, resp.ID)
+	return p.header, p.body, p.err
 }
 
 func (c *Client) receive() {
@@ -155,12 +458,62 @@ func (c *Client) receive() {
 		if err != nil {
 			break
 		}
+		if response.Type == ResponseWindowUpdate {
+			var n int
+			if n, err = decodeWindowUpdate(data); err == nil {
+				c.window.update(response.ID, n)
+			}
+			continue
+		}
+		var updates []windowUpdate
+		if updates, err = c.credit.received(response.ID, len(data)); err != nil {
+			break
+		}
+		c.returnCredit(updates)
+		size := len(data)
+		var bodyErr error
+		if response, data, bodyErr = c.assemble(response, data); response == nil {
+			continue
+		}
 
-		call := c.getCall(response.ID)
-		c.removeCall(response.ID)
+		switch response.Type {
+		case ResponseMessage:
+			if bodyErr != nil {
+				// The stream can't go on without the message.
+				if s := c.takeStream(response.ID); s != nil {
+					s.finish(nil, bodyErr)
+					go c.sendCancel(response.ID)
+				}
+				continue
+			}
+			// s is nil if the stream was abandoned; drop the message.
+			if s := c.getStream(response.ID); s != nil {
+				s.recv.push(data, size)
+			}
+			continue
+		case ResponseEnd:
+			if s := c.takeStream(response.ID); s != nil {
+				err := response.Err()
+				if err == nil {
+					err = io.EOF
+				}
+				s.finish(response.Metadata, err)
+			}
+			continue
+		}
+
+		// call is nil if it was abandoned by its context; drop the reply.
+		c.credit.forget(response.ID)
+		call := c.takeCall(response.ID)
 		if call != nil {
-			if response.Error != "" {
-				call.Error = errors.New(response.Error)
+			call.Metadata = response.Metadata
+			if md, ok := call.ctx.Value(capturedMetadataKey{}).(*Metadata); ok {
+				*md = response.Metadata
+			}
+			if err := response.Err(); err != nil {
+				call.Error = err
+			} else if bodyErr != nil {
+				call.Error = bodyErr
 			} else if err := call.Reply.Unmarshal(data); err != nil {
 				call.Error = err
 			}
@@ -179,15 +532,27 @@ func (c *Client) receive() {
 			err = io.ErrUnexpectedEOF
 		}
 	}
-	for _, call := range c.pending {
+	c.window.close(err)
+	for seq, call := range c.pending {
+		delete(c.pending, seq)
 		call.Error = err
 		call.done()
 	}
+	for seq, s := range c.streams {
+		delete(c.streams, seq)
+		s.finish(nil, err)
+	}
 	c.mu.Unlock()
 	c.sending.Unlock()
-	if err != io.EOF && !closing {
-		log.Println("rcc: client protocol error:", err)
+	if !closing {
+		level := LevelWarn
+		if err == io.ErrUnexpectedEOF {
+			// The server went away.
+			level = LevelDebug
+		}
+		c.logger.Log(level, "rpc:connection failed", "err", err)
 	}
+	close(c.done)
 }
 
 func (c *Client) writeRequest(req *RequestHeader, body []byte) error {
@@ -199,18 +564,15 @@ func (c *Client) writeRequest(req *RequestHeader, body []byte) error {
 
 func (c *Client) readResponse(resp *ResponseHeader) ([]byte, error) {
 	if err := c.codec.ReadResponseHeader(resp); err != nil {
-		log.Println("rpc:failed to read response header, err:", err)
 		return nil, err
 	}
 
 	data, err := c.codec.ReadResponseBody()
 	if err != nil {
-		log.Println("rpc:failed to read response body, err:", err)
 		return nil, err
 	}
 
 	if resp.Checksum != crc32.ChecksumIEEE(data) {
-		log.Println("rpc:response checksum mismatch")
 		return nil, fmt.Errorf("response checksum mismatch")
 	}
 
@@ -225,59 +587,99 @@ type ClientCodec interface {
 }
 
 type clientCodec struct {
-	r io.Reader
-	w io.Writer
-	c io.Closer
+	r      io.Reader
+	w      io.Writer
+	c      io.Closer
+	limits Limits
+
+	sentPreface bool     // guarded by the writer
+	gotPreface  bool     // guarded by the reader
+	features    Features // negotiated with the server
 }
 
+// NewClientCodec returns a ClientCodec for conn with DefaultLimits.
 func NewClientCodec(conn io.ReadWriteCloser) ClientCodec {
+	return newClientCodec(conn, DefaultLimits)
+}
+
+func newClientCodec(conn io.ReadWriteCloser, limits Limits) *clientCodec {
 	return &clientCodec{
-		r: bufio.NewReader(conn),
-		w: bufio.NewWriter(conn),
-		c: conn,
+		r:      bufio.NewReader(conn),
+		w:      bufio.NewWriter(conn),
+		c:      conn,
+		limits: limits,
 	}
 }
 
 func (c *clientCodec) WriteRequest(req *RequestHeader, body []byte) error {
+	if !c.sentPreface {
+		if err := writePreface(c.w, localPreface()); err != nil {
+			return err
+		}
+		c.sentPreface = true
+	}
 	if err := sendFrame(c.w, req.Marshal()); err != nil {
-		log.Printf("rpc:failed to send request header, err is %s", err)
 		return err
 	}
 	if err := sendFrame(c.w, body); err != nil {
-		log.Printf("rpc:failed to send request body, err is %s", err)
 		return err
 	}
 
-	c.w.(*bufio.Writer).Flush()
-	return nil
+	return c.w.(*bufio.Writer).Flush()
 }
 
 func (c *clientCodec) ReadResponseHeader(r *ResponseHeader) error {
-	data, err := recvFrame(c.r)
+	if !c.gotPreface {
+		p, err := readPreface(c.r)
+		if err != nil {
+			return err
+		}
+		c.features = p.Features & supportedFeatures
+		c.gotPreface = true
+	}
+
+	data, err := recvFrame(c.r, c.limits.MaxHeaderSize)
 	if err != nil {
-		log.Printf("rpc:failed to receive response header, err is %s", err)
 		return err
 	}
 
 	return r.Unmarshal(data)
 }
 
-func (c *clientCodec) ReadResponseBody() (data []byte, err error) {
-	data, err = recvFrame(c.r)
-	if err != nil {
-		log.Printf("rpc:failed to receive response body, err is %s", err)
-	}
-	return
+func (c *clientCodec) ReadResponseBody() ([]byte, error) {
+	return recvFrame(c.r, c.limits.MaxBodySize)
 }
 
 func (c *clientCodec) Close() error {
 	return c.c.Close()
 }
 
-func Dial(network, address string) (*Client, error) {
-	conn, err := net.Dial(network, address)
+// Dial connects to the server at address and returns a client for it,
+// configured by opts.
+func Dial(network, address string, opts ...DialOption) (*Client, error) {
+	o := defaultDialOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	dialer := net.Dialer{Timeout: o.timeout}
+	conn, err := dialer.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn, opts...), nil
+}
+
+// DialTLS is like Dial, but connects over crypto/tls using config. To
+// authenticate the client with mutual TLS, set config.Certificates.
+func DialTLS(network, address string, config *tls.Config, opts ...DialOption) (*Client, error) {
+	o := defaultDialOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	dialer := &net.Dialer{Timeout: o.timeout}
+	conn, err := tls.DialWithDialer(dialer, network, address, config)
 	if err != nil {
 		return nil, err
 	}
-	return NewClient(conn), nil
+	return NewClient(conn, opts...), nil
 }
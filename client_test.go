@@ -0,0 +1,154 @@
+package drpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startSleepServer starts a server whose "Sleep.Sleep" method blocks for the
+// number of milliseconds in args.A before replying, and whose "Sleep.Fail"
+// method always fails.
+func startSleepServer(t *testing.T) string {
+	return serveSleep(t, NewServer())
+}
+
+func serveSleep(t *testing.T, server *Server) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveSleepOn(server, listener)
+	return listener.Addr().String()
+}
+
+func serveSleepOn(server *Server, listener net.Listener) {
+	RegisterService(server, "Sleep.Sleep", func(req []byte) ([]byte, error) {
+		args := new(mathArgs)
+		if err := args.Unmarshal(req); err != nil {
+			return nil, err
+		}
+		time.Sleep(time.Duration(args.A) * time.Millisecond)
+		return (&mathReply{C: args.A}).Marshal()
+	})
+	RegisterService(server, "Sleep.Fail", func(req []byte) ([]byte, error) {
+		return nil, errors.New("boom")
+	})
+	go server.Serve(listener)
+}
+
+func TestCallContextDeadline(t *testing.T) {
+	client, err := Dial("tcp", startSleepServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = client.CallContext(ctx, "Sleep.Sleep", &mathArgs{A: 200}, new(mathReply))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	client.mu.Lock()
+	assert.Empty(t, client.pending)
+	client.mu.Unlock()
+
+	// The late reply to the abandoned call must not disturb later calls.
+	reply := new(mathReply)
+	err = client.Call("Sleep.Sleep", &mathArgs{A: 1}, reply)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, reply.C)
+}
+
+func TestGoContextCancel(t *testing.T) {
+	client, err := Dial("tcp", startSleepServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	call := client.GoContext(ctx, "Sleep.Sleep", &mathArgs{A: 200}, new(mathReply))
+	cancel()
+	<-call.Done
+	assert.ErrorIs(t, call.Error, context.Canceled)
+
+	call = client.GoContext(ctx, "Sleep.Sleep", &mathArgs{A: 1}, new(mathReply))
+	<-call.Done
+	assert.ErrorIs(t, call.Error, context.Canceled)
+}
+
+func TestUnaryClientInterceptors(t *testing.T) {
+	type record struct {
+		method  string
+		elapsed time.Duration
+		err     error
+	}
+	records := make(chan record, 10)
+	metrics := func(ctx context.Context, serviceMethod string, args, reply Serializer, invoker UnaryInvoker) error {
+		start := time.Now()
+		err := invoker(ctx, serviceMethod, args, reply)
+		records <- record{serviceMethod, time.Since(start), err}
+		return err
+	}
+	attempts := 0
+	retry := func(ctx context.Context, serviceMethod string, args, reply Serializer, invoker UnaryInvoker) error {
+		var err error
+		for i := 0; i < 3; i++ {
+			attempts++
+			if err = invoker(ctx, serviceMethod, args, reply); err == nil {
+				break
+			}
+		}
+		return err
+	}
+	client, err := Dial("tcp", startSleepServer(t), WithClientInterceptors(metrics, retry))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	reply := new(mathReply)
+	assert.NoError(t, client.Call("Sleep.Sleep", &mathArgs{A: 20}, reply))
+	assert.Equal(t, 20, reply.C)
+	r := <-records
+	assert.Equal(t, "Sleep.Sleep", r.method)
+	assert.GreaterOrEqual(t, r.elapsed, 20*time.Millisecond)
+	assert.NoError(t, r.err)
+	assert.Equal(t, 1, attempts)
+
+	call := <-client.Go("Sleep.Fail", &mathArgs{}, new(mathReply)).Done
+	assert.Equal(t, NewError(Unknown, "boom"), call.Error)
+	assert.Equal(t, call.Error, (<-records).err)
+	assert.Equal(t, 4, attempts)
+}
+
+func TestUnaryClientInterceptorMetadata(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer()
+	RegisterServiceContext(server, "Echo.Token", func(ctx context.Context, req []byte) ([]byte, error) {
+		SetResponseMetadata(ctx, "token", IncomingMetadata(ctx).Get("token"))
+		return nil, nil
+	})
+	go server.Serve(listener)
+
+	signed := func(ctx context.Context, serviceMethod string, args, reply Serializer, invoker UnaryInvoker) error {
+		return invoker(AppendToOutgoingContext(ctx, "token", "signed"), serviceMethod, args, reply)
+	}
+	client, err := Dial("tcp", listener.Addr().String(), WithClientInterceptors(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	call := <-client.Go("Echo.Token", new(rawArgs), new(rawArgs)).Done
+	assert.NoError(t, call.Error)
+	assert.Equal(t, Metadata{"token": "signed"}, call.Metadata)
+}
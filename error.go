@@ -1,8 +1,179 @@
 package drpc
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"fmt"
+)
 
 var (
 	ErrUnmarshal = errors.New("an error occurred in Unmarshal")
 	ErrShutdown  = errors.New("connection is shut down")
+
+	// ErrServerDraining is returned for requests that reach a server after
+	// Shutdown was called.
+	ErrServerDraining = NewError(Unavailable, "server draining")
+
+	// ErrUnavailable is returned by the calls of a ReconnectingClient that
+	// has no connection and doesn't wait for one.
+	ErrUnavailable = NewError(Unavailable, "no connection to the server")
+
+	// ErrServerClosed is returned by Server.Serve after Shutdown or Close.
+	ErrServerClosed = errors.New("server closed")
+
+	// ErrBadPreface means the peer did not start the connection with a drpc
+	// preface, i.e. it doesn't speak drpc at all.
+	ErrBadPreface = errors.New("peer did not send a drpc preface")
+	// ErrVersionMismatch means the peer speaks another version of the
+	// protocol.
+	ErrVersionMismatch = errors.New("protocol version mismatch")
 )
+
+// Code tells what kind of failure an Error reports. The values match those
+// of gRPC, so they are easy to map onto other systems.
+type Code uint32
+
+const (
+	OK                 Code = 0  // not an error
+	Canceled           Code = 1  // the caller cancelled the call
+	Unknown            Code = 2  // the handler returned an error that isn't an *Error
+	InvalidArgument    Code = 3  // the request is malformed, whatever the state of the server
+	DeadlineExceeded   Code = 4  // the deadline passed before the call completed
+	NotFound           Code = 5  // the method or an entity it needs was not found
+	AlreadyExists      Code = 6  // the entity the call tried to create exists
+	PermissionDenied   Code = 7  // the caller may not perform the call
+	ResourceExhausted  Code = 8  // a quota or size limit was hit
+	FailedPrecondition Code = 9  // the system is not in a state the call requires
+	Aborted            Code = 10 // the call was aborted, e.g. by a concurrency conflict
+	OutOfRange         Code = 11 // the call went past a valid range
+	Unimplemented      Code = 12 // the server doesn't implement the call
+	Internal           Code = 13 // an invariant of the server is broken
+	Unavailable        Code = 14 // the server can't take the call right now; retrying may help
+	DataLoss           Code = 15 // data was lost or corrupted
+	Unauthenticated    Code = 16 // the caller has no valid credentials
+)
+
+var codeNames = [...]string{
+	OK:                 "OK",
+	Canceled:           "Canceled",
+	Unknown:            "Unknown",
+	InvalidArgument:    "InvalidArgument",
+	DeadlineExceeded:   "DeadlineExceeded",
+	NotFound:           "NotFound",
+	AlreadyExists:      "AlreadyExists",
+	PermissionDenied:   "PermissionDenied",
+	ResourceExhausted:  "ResourceExhausted",
+	FailedPrecondition: "FailedPrecondition",
+	Aborted:            "Aborted",
+	OutOfRange:         "OutOfRange",
+	Unimplemented:      "Unimplemented",
+	Internal:           "Internal",
+	Unavailable:        "Unavailable",
+	DataLoss:           "DataLoss",
+	Unauthenticated:    "Unauthenticated",
+}
+
+func (c Code) String() string {
+	if int(c) < len(codeNames) {
+		return codeNames[c]
+	}
+	return fmt.Sprintf("Code(%d)", uint32(c))
+}
+
+// Detail is a typed payload attached to an Error, e.g. which field of the
+// request was invalid or how long to wait before retrying. Type tells the
+// receiver how to decode Value.
+type Detail struct {
+	Type  string
+	Value []byte
+}
+
+// Error is the error a server sends back when a call fails, and the error
+// a Client returns for it. Handlers can return an *Error to choose the code
+// the caller sees; any other error is reported with the Unknown code.
+type Error struct {
+	Code    Code
+	Message string
+	Details []Detail
+}
+
+// NewError returns an Error with the given code and message.
+func NewError(code Code, message string) *Error {
+	return &Error{
+		Code:    code,
+		Message: message,
+	}
+}
+
+// Errorf returns an Error with the given code and a formatted message.
+func Errorf(code Code, format string, a ...interface{}) *Error {
+	return NewError(code, fmt.Sprintf(format, a...))
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rpc error: code = %s desc = %s", e.Code, e.Message)
+}
+
+// Is reports whether target is an *Error with the same code and message, so
+// that errors.Is works across the wire for sentinel errors like
+// ErrServerDraining. Canceled and DeadlineExceeded errors also match
+// context.Canceled and context.DeadlineExceeded, so a call that runs out of
+// time looks the same whether the client or the server noticed first.
+func (e *Error) Is(target error) bool {
+	switch target {
+	case context.Canceled:
+		return e.Code == Canceled
+	case context.DeadlineExceeded:
+		return e.Code == DeadlineExceeded
+	}
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+	return e.Code == t.Code && e.Message == t.Message
+}
+
+// WithDetails returns a copy of e with details appended.
+func (e *Error) WithDetails(details ...Detail) *Error {
+	out := *e
+	out.Details = append(e.Details[:len(e.Details):len(e.Details)], details...)
+	return &out
+}
+
+// Detail returns the value of the first detail of the given type.
+func (e *Error) Detail(typ string) ([]byte, bool) {
+	for _, d := range e.Details {
+		if d.Type == typ {
+			return d.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Convert returns err as an *Error. Context errors map to Canceled and
+// DeadlineExceeded, other errors that aren't already an *Error to Unknown.
+// Convert(nil) is nil.
+func Convert(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		return NewError(Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return NewError(DeadlineExceeded, err.Error())
+	}
+	return NewError(Unknown, err.Error())
+}
+
+// CodeOf returns the code of err as Convert sees it, or OK if err is nil.
+func CodeOf(err error) Code {
+	if err == nil {
+		return OK
+	}
+	return Convert(err).Code
+}
@@ -0,0 +1,268 @@
+package drpc
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+const (
+	// MaxFragmentSize is the largest body a single frame carries. Larger
+	// bodies are split into continuation frames.
+	MaxFragmentSize = 16 << 10
+
+	// StreamWindowSize is how many body bytes a side may send on one ID
+	// before the other side returns credit for them.
+	StreamWindowSize = 256 << 10
+	// ConnWindowSize is how many body bytes a side may send on the whole
+	// connection before the other side returns credit for them.
+	ConnWindowSize = 1 << 20
+)
+
+// connWindowID is the ID of window updates for the whole connection. The
+// client never uses it for a call.
+const connWindowID = 0
+
+// sendWindow tracks the credit a side has left for sending body bytes, per
+// ID and for the whole connection. Frames with an empty body need no credit,
+// so headers, cancels and window updates are never held up.
+type sendWindow struct {
+	mu      sync.Mutex
+	conn    int
+	ids     map[uint64]int
+	changed chan struct{} // closed and replaced when credit is added
+	err     error         // set once the connection is gone
+}
+
+func newSendWindow() *sendWindow {
+	return &sendWindow{
+		conn:    ConnWindowSize,
+		ids:     make(map[uint64]int),
+		changed: make(chan struct{}),
+	}
+}
+
+// open starts tracking credit for id.
+func (w *sendWindow) open(id uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.ids[id]; !ok {
+		w.ids[id] = StreamWindowSize
+	}
+}
+
+// forget stops tracking credit for id. Reservations waiting on it fail with
+// io.EOF.
+func (w *sendWindow) forget(id uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.ids, id)
+	w.notifyLocked()
+}
+
+// reserve takes up to size bytes of credit for id, waiting until there is
+// some. It returns how many bytes it took, which is at least one unless size
+// is zero.
+func (w *sendWindow) reserve(ctx context.Context, id uint64, size int) (int, error) {
+	if size == 0 {
+		return 0, nil
+	}
+	for {
+		w.mu.Lock()
+		if w.err != nil {
+			err := w.err
+			w.mu.Unlock()
+			return 0, err
+		}
+		avail, ok := w.ids[id]
+		if !ok {
+			w.mu.Unlock()
+			return 0, io.EOF
+		}
+		n := size
+		if avail < n {
+			n = avail
+		}
+		if w.conn < n {
+			n = w.conn
+		}
+		if n > 0 {
+			w.ids[id] -= n
+			w.conn -= n
+			w.mu.Unlock()
+			return n, nil
+		}
+		changed := w.changed
+		w.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// update adds n bytes of credit to id, or to the connection if id is
+// connWindowID. Credit for IDs that aren't tracked is dropped.
+func (w *sendWindow) update(id uint64, n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if id == connWindowID {
+		w.conn += n
+	} else if _, ok := w.ids[id]; ok {
+		w.ids[id] += n
+	} else {
+		return
+	}
+	w.notifyLocked()
+}
+
+// close makes all current and later reservations fail with err.
+func (w *sendWindow) close(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+		w.notifyLocked()
+	}
+}
+
+func (w *sendWindow) notifyLocked() {
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// windowUpdate is credit to return to the other side.
+type windowUpdate struct {
+	id uint64
+	n  int
+}
+
+// recvWindow collects the credit a side owes the other side, and hands it
+// out in batches so that small messages don't cost a window update each.
+// Connection credit is owed as soon as a body arrives, so that messages
+// nobody reads only stall their own ID; credit for an ID is owed once the
+// application consumed the message. It also tracks the credit the other side
+// has left, to catch a peer that sends more than it was given.
+type recvWindow struct {
+	mu       sync.Mutex
+	conn     int // owed on the connection
+	connLeft int // the other side may still send on the connection
+	ids      map[uint64]*idCredit
+}
+
+type idCredit struct {
+	owed int
+	left int
+}
+
+// errWindowExceeded breaks a connection whose peer sent more than its
+// window allowed.
+var errWindowExceeded = NewError(ResourceExhausted, "peer exceeded its flow control window")
+
+func newRecvWindow() *recvWindow {
+	return &recvWindow{
+		connLeft: ConnWindowSize,
+		ids:      make(map[uint64]*idCredit),
+	}
+}
+
+// received records that n body bytes arrived on id and returns the window
+// update of the connection that is due, if any. It fails with
+// errWindowExceeded if the bytes exceed the credit of the connection, or of
+// id if it is open.
+func (w *recvWindow) received(id uint64, n int) ([]windowUpdate, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.connLeft -= n
+	if w.connLeft < 0 {
+		return nil, errWindowExceeded
+	}
+	if c, ok := w.ids[id]; ok {
+		if c.left -= n; c.left < 0 {
+			return nil, errWindowExceeded
+		}
+	}
+	return w.oweLocked(n), nil
+}
+
+// withhold takes back n bytes of connection credit until they are returned
+// with release; until then the other side has n bytes less room.
+func (w *recvWindow) withhold(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.conn -= n
+}
+
+// release returns the n bytes of connection credit taken back by withhold,
+// and returns the window update that is due, if any.
+func (w *recvWindow) release(n int) []windowUpdate {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.oweLocked(n)
+}
+
+// oweLocked adds n bytes to the credit owed on the connection and returns the
+// window update that is due, if any.
+func (w *recvWindow) oweLocked(n int) []windowUpdate {
+	w.conn += n
+	if w.conn < ConnWindowSize/4 {
+		return nil
+	}
+	update := windowUpdate{connWindowID, w.conn}
+	w.connLeft += w.conn
+	w.conn = 0
+	return []windowUpdate{update}
+}
+
+// open starts collecting credit for id. Credit already collected for an open
+// id is kept.
+func (w *recvWindow) open(id uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.ids[id]; !ok {
+		w.ids[id] = &idCredit{left: StreamWindowSize}
+	}
+}
+
+// consumed records that n body bytes received on id were consumed and
+// returns the window update that is due, if any. Nothing is owed for IDs
+// that aren't open.
+func (w *recvWindow) consumed(id uint64, n int) []windowUpdate {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	c, ok := w.ids[id]
+	if !ok {
+		return nil
+	}
+	c.owed += n
+	if c.owed < StreamWindowSize/4 {
+		return nil
+	}
+	update := windowUpdate{id, c.owed}
+	c.left += c.owed
+	c.owed = 0
+	return []windowUpdate{update}
+}
+
+// forget stops collecting credit for id once it's finished.
+func (w *recvWindow) forget(id uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.ids, id)
+}
+
+func encodeWindowUpdate(n int) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return buf[:binary.PutUvarint(buf, uint64(n))]
+}
+
+func decodeWindowUpdate(body []byte) (int, error) {
+	n, size := binary.Uvarint(body)
+	if size <= 0 || size != len(body) || n > ConnWindowSize {
+		return 0, ErrUnmarshal
+	}
+	return int(n), nil
+}
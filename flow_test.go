@@ -0,0 +1,347 @@
+package drpc
+
+import (
+	"bytes"
+	"context"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startBulkServer starts a server whose "Bulk.Echo" method replies with its
+// request, whose "Bulk.Download" method streams args.A messages of args.B
+// bytes, and whose "Bulk.Hold" method doesn't read its stream until release
+// is closed and then replies with the number of bytes it received.
+func startBulkServer(t *testing.T, opts ...ServerOption) (addr string, release chan struct{}) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release = make(chan struct{})
+	server := NewServer(opts...)
+	RegisterService(server, "Bulk.Echo", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	RegisterServerStreamService(server, "Bulk.Download", func(req []byte, stream ServerStream) error {
+		args := new(mathArgs)
+		if err := args.Unmarshal(req); err != nil {
+			return err
+		}
+		msg := rawArgs(bytes.Repeat([]byte{'x'}, args.B))
+		for i := 0; i < args.A; i++ {
+			if err := stream.Send(&msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	RegisterStreamService(server, "Bulk.Hold", func(stream ServerStream) error {
+		<-release
+		n := 0
+		for {
+			msg := new(rawArgs)
+			if err := stream.Recv(msg); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			n += len(*msg)
+		}
+		return stream.Send(&mathReply{C: n})
+	})
+	go server.Serve(listener)
+	return listener.Addr().String(), release
+}
+
+func TestLargeBody(t *testing.T) {
+	addr, _ := startBulkServer(t)
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Larger than both windows, so it only gets through if credit flows back.
+	body := make([]byte, 3*ConnWindowSize+123)
+	rand.Read(body)
+	args, reply := rawArgs(body), new(rawArgs)
+	assert.NoError(t, client.Call("Bulk.Echo", &args, reply))
+	assert.Equal(t, body, []byte(*reply))
+}
+
+func TestLargeServerStream(t *testing.T) {
+	addr, _ := startBulkServer(t)
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	stream, err := client.CallStream(context.Background(), "Bulk.Download", &mathArgs{A: 40, B: 100 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for {
+		msg := new(rawArgs)
+		if err := stream.Recv(msg); err != nil {
+			assert.ErrorIs(t, err, io.EOF)
+			break
+		}
+		assert.Len(t, *msg, 100<<10)
+		n++
+	}
+	assert.Equal(t, 40, n)
+}
+
+func TestLargeClientStream(t *testing.T) {
+	addr, release := startBulkServer(t)
+	close(release)
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.NewStream(ctx, "Bulk.Hold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each message is fragmented, and together they need the credit of the
+	// stream to come back several times.
+	msg := rawArgs(make([]byte, 40<<10))
+	for i := 0; i < 50; i++ {
+		if err := stream.Send(&msg); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+	assert.NoError(t, stream.CloseSend())
+	total := new(mathReply)
+	assert.NoError(t, stream.Recv(total))
+	assert.Equal(t, 50*len(msg), total.C)
+}
+
+func TestStalledStreamDoesNotBlockCalls(t *testing.T) {
+	addr, release := startBulkServer(t)
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	stream, err := client.NewStream(context.Background(), "Bulk.Hold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := make(chan error, 1)
+	go func() {
+		msg := rawArgs(make([]byte, 64<<10))
+		for i := 0; i < 2*StreamWindowSize/len(msg); i++ {
+			if err := stream.Send(&msg); err != nil {
+				sent <- err
+				return
+			}
+		}
+		sent <- stream.CloseSend()
+	}()
+
+	// Wait until the stream has used up its window.
+	for deadline := time.Now().Add(time.Second); ; {
+		client.window.mu.Lock()
+		left := client.window.ids[stream.id]
+		client.window.mu.Unlock()
+		if left == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the stream didn't use up its window")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	args, reply := rawArgs("ping"), new(rawArgs)
+	assert.NoError(t, client.CallContext(ctx, "Bulk.Echo", &args, reply))
+	assert.Equal(t, "ping", string(*reply))
+	select {
+	case <-sent:
+		t.Fatal("send went beyond the window of the stream")
+	default:
+	}
+
+	close(release)
+	assert.NoError(t, <-sent)
+	total := new(mathReply)
+	assert.NoError(t, stream.Recv(total))
+	assert.Equal(t, 2*StreamWindowSize, total.C)
+}
+
+func TestStreamHoldingTheOnlySlot(t *testing.T) {
+	addr, _ := startBulkServer(t, WithMaxConcurrentRequests(1))
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.CallStream(ctx, "Bulk.Download", &mathArgs{A: 40, B: 64 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The calls wait for the stream, which waits for the window updates of
+	// the client once its window is used up.
+	var calls []*Call
+	for i := 0; i < 2; i++ {
+		args := rawArgs("ping")
+		calls = append(calls, client.GoContext(ctx, "Bulk.Echo", &args, new(rawArgs)))
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	for i := 0; i < 40; i++ {
+		msg := new(rawArgs)
+		if err := stream.Recv(msg); err != nil {
+			t.Fatalf("recv %d: %v", i, err)
+		}
+		assert.Len(t, *msg, 64<<10)
+	}
+	assert.ErrorIs(t, stream.Recv(new(rawArgs)), io.EOF)
+	for _, call := range calls {
+		<-call.Done
+		assert.NoError(t, call.Error)
+	}
+}
+
+// dialRaw connects to addr with a bare codec, to send what a Client wouldn't.
+func dialRaw(t *testing.T, addr string) ClientCodec {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	codec := NewClientCodec(conn)
+	t.Cleanup(func() { codec.Close() })
+	return codec
+}
+
+func TestWindowExceededClosesConnection(t *testing.T) {
+	addr, release := startBulkServer(t)
+	defer close(release)
+	codec := dialRaw(t, addr)
+
+	// Bulk.Hold doesn't read its stream, so the window of the stream isn't
+	// returned, and the client goes beyond it.
+	open := &RequestHeader{Type: RequestStream, ID: 1, Method: "Bulk.Hold", Checksum: crc32.ChecksumIEEE(nil)}
+	assert.NoError(t, codec.WriteRequest(open, nil))
+	body := make([]byte, MaxFragmentSize)
+	for i := 0; i <= StreamWindowSize/MaxFragmentSize; i++ {
+		msg := &RequestHeader{Type: RequestMessage, ID: 1, Checksum: crc32.ChecksumIEEE(body)}
+		if err := codec.WriteRequest(msg, body); err != nil {
+			break
+		}
+	}
+	for {
+		resp := new(ResponseHeader)
+		if err := codec.ReadResponseHeader(resp); err != nil {
+			assert.ErrorIs(t, err, io.EOF)
+			return
+		}
+		codec.ReadResponseBody()
+		assert.Equal(t, ResponseWindowUpdate, resp.Type)
+	}
+}
+
+func TestTooManyPartialRequests(t *testing.T) {
+	addr, _ := startBulkServer(t)
+	codec := dialRaw(t, addr)
+
+	n := maxPartialRequests + 1
+	first, rest := []byte("ab"), []byte("cd")
+	for id := 1; id <= n; id++ {
+		req := &RequestHeader{ID: uint64(id), Flags: FlagMore, Method: "Bulk.Echo", Checksum: crc32.ChecksumIEEE(first)}
+		assert.NoError(t, codec.WriteRequest(req, first))
+	}
+	for id := 1; id <= n; id++ {
+		req := &RequestHeader{Type: RequestContinuation, ID: uint64(id), Checksum: crc32.ChecksumIEEE(rest)}
+		assert.NoError(t, codec.WriteRequest(req, rest))
+	}
+
+	codes := make(map[uint64]Code)
+	for i := 0; i < n; i++ {
+		resp := new(ResponseHeader)
+		assert.NoError(t, codec.ReadResponseHeader(resp))
+		body, err := codec.ReadResponseBody()
+		assert.NoError(t, err)
+		codes[resp.ID] = resp.Code
+		if resp.Code == OK {
+			assert.Equal(t, "abcd", string(body))
+		}
+	}
+	assert.Len(t, codes, n)
+	for id, code := range codes {
+		if id == uint64(n) {
+			assert.Equal(t, ResourceExhausted, code)
+		} else {
+			assert.Equal(t, OK, code, id)
+		}
+	}
+}
+
+func TestRequestTooLarge(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(WithServerLimits(Limits{MaxBodySize: 64 << 10}))
+	RegisterService(server, "Bulk.Echo", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	go server.Serve(listener)
+
+	client, err := Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	args := rawArgs(make([]byte, 100<<10))
+	err = client.Call("Bulk.Echo", &args, new(rawArgs))
+	assert.Equal(t, ResourceExhausted, CodeOf(err))
+
+	// Only the oversized request fails.
+	args, reply := rawArgs("ping"), new(rawArgs)
+	assert.NoError(t, client.Call("Bulk.Echo", &args, reply))
+	assert.Equal(t, "ping", string(*reply))
+}
+
+func TestResponseTooLarge(t *testing.T) {
+	addr, _ := startBulkServer(t)
+	client, err := Dial("tcp", addr, WithClientLimits(Limits{MaxBodySize: 64 << 10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	args := rawArgs(make([]byte, 100<<10))
+	err = client.Call("Bulk.Echo", &args, new(rawArgs))
+	assert.Equal(t, ResourceExhausted, CodeOf(err))
+
+	stream, err := client.CallStream(context.Background(), "Bulk.Download", &mathArgs{A: 1, B: 100 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ResourceExhausted, CodeOf(stream.Recv(new(rawArgs))))
+
+	args, reply := rawArgs("ping"), new(rawArgs)
+	assert.NoError(t, client.Call("Bulk.Echo", &args, reply))
+	assert.Equal(t, "ping", string(*reply))
+}
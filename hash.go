@@ -0,0 +1,130 @@
+package drpc
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// ringReplicas is the number of points a backend of weight one has on the
+// ring of a ConsistentHash policy. More points spread the keys more evenly.
+const ringReplicas = 100
+
+// KeyFunc returns the key a ConsistentHash policy routes a call by, or "" if
+// the call has none.
+type KeyFunc func(info PickInfo) string
+
+// MetadataKey returns a KeyFunc that takes the key from the outgoing metadata
+// entry called name.
+func MetadataKey(name string) KeyFunc {
+	return func(info PickInfo) string {
+		if info.Ctx == nil {
+			return ""
+		}
+		return OutgoingMetadata(info.Ctx).Get(name)
+	}
+}
+
+// ArgsKey returns a KeyFunc that computes the key from the args of a call.
+// Calls without args, i.e. streams opened by NewStream, have no key.
+func ArgsKey(key func(args Serializer) string) KeyFunc {
+	return func(info PickInfo) string {
+		if info.Args == nil {
+			return ""
+		}
+		return key(info.Args)
+	}
+}
+
+type ringPoint struct {
+	hash    uint64
+	backend int // index into the backends the ring was built for
+}
+
+type consistentHash struct {
+	key  KeyFunc
+	next uint32 // picks calls without a key in turn
+
+	mu       sync.RWMutex // protects following
+	backends []Address    // the ring was built for
+	ring     []ringPoint  // sorted by hash
+}
+
+// ConsistentHash returns a Policy that sends the calls with the same key to
+// the same backend. Each backend owns the keys that hash onto its points of a
+// ring, Weight times ringReplicas of them, so when a backend comes or goes
+// only the keys it owns move. Calls without a key are spread in turn.
+func ConsistentHash(key KeyFunc) Policy {
+	return &consistentHash{key: key}
+}
+
+func (p *consistentHash) Pick(info PickInfo, backends []*Backend) *Backend {
+	key := p.key(info)
+	if key == "" {
+		n := atomic.AddUint32(&p.next, 1) - 1
+		return backends[n%uint32(len(backends))]
+	}
+	ring := p.ringFor(backends)
+	h := hashString(key)
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	if i == len(ring) {
+		i = 0
+	}
+	return backends[ring[i].backend]
+}
+
+// ringFor returns the ring of backends, building it if the backends changed
+// since the last call.
+func (p *consistentHash) ringFor(backends []*Backend) []ringPoint {
+	p.mu.RLock()
+	ring, ok := p.ring, sameAddresses(p.backends, backends)
+	p.mu.RUnlock()
+	if ok {
+		return ring
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if sameAddresses(p.backends, backends) {
+		return p.ring
+	}
+	addrs := make([]Address, len(backends))
+	ring = nil
+	for i, be := range backends {
+		addrs[i] = be.Address
+		for j := 0; j < ringReplicas*be.weight(); j++ {
+			ring = append(ring, ringPoint{hashString(be.Addr + "#" + strconv.Itoa(j)), i})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	p.backends, p.ring = addrs, ring
+	return ring
+}
+
+func sameAddresses(addrs []Address, backends []*Backend) bool {
+	if len(addrs) != len(backends) {
+		return false
+	}
+	for i, be := range backends {
+		if addrs[i] != be.Address {
+			return false
+		}
+	}
+	return true
+}
+
+// hashString hashes s with FNV-1a and mixes the result, since FNV alone
+// spreads similar strings like "host#1" and "host#2" poorly.
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,110 @@
+package drpc
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func keyInfo(key string) PickInfo {
+	return PickInfo{Ctx: AppendToOutgoingContext(context.Background(), "user", key)}
+}
+
+// owners returns the address of the backend each of n keys goes to.
+func owners(p Policy, backends []*Backend, n int) []string {
+	addrs := make([]string, n)
+	for i := range addrs {
+		addrs[i] = p.Pick(keyInfo(strconv.Itoa(i)), backends).Addr
+	}
+	return addrs
+}
+
+func TestConsistentHashSpreadsKeys(t *testing.T) {
+	p := ConsistentHash(MetadataKey("user"))
+	counts := make(map[string]int)
+	for _, addr := range owners(p, testBackends(1, 1, 1), 3000) {
+		counts[addr]++
+	}
+	assert.Len(t, counts, 3)
+	for addr, n := range counts {
+		assert.InDelta(t, 1000, n, 200, addr)
+	}
+
+	// A backend of weight two gets about twice the keys.
+	counts = make(map[string]int)
+	for _, addr := range owners(p, testBackends(2, 1), 3000) {
+		counts[addr]++
+	}
+	assert.InDelta(t, 2000, counts["a"], 300)
+}
+
+func TestConsistentHashMovesFewKeys(t *testing.T) {
+	p := ConsistentHash(MetadataKey("user"))
+	backends := testBackends(1, 1, 1, 1)
+	before := owners(p, backends, 1000)
+
+	// Without "b", only the keys of "b" move.
+	after := owners(p, append([]*Backend{backends[0]}, backends[2:]...), 1000)
+	for i := range before {
+		if before[i] != "b" {
+			assert.Equal(t, before[i], after[i])
+		} else {
+			assert.NotEqual(t, "b", after[i])
+		}
+	}
+
+	// With a fifth backend, only about a fifth of the keys move.
+	after = owners(p, testBackends(1, 1, 1, 1, 1), 1000)
+	moved := 0
+	for i := range before {
+		if before[i] != after[i] {
+			assert.Equal(t, "e", after[i])
+			moved++
+		}
+	}
+	assert.InDelta(t, 200, moved, 100)
+}
+
+func TestConsistentHashKeys(t *testing.T) {
+	backends := testBackends(1, 1, 1)
+
+	byArgs := ConsistentHash(ArgsKey(func(args Serializer) string {
+		return strconv.Itoa(args.(*mathArgs).A)
+	}))
+	first := byArgs.Pick(PickInfo{Args: &mathArgs{A: 42}}, backends)
+	for i := 0; i < 10; i++ {
+		assert.Same(t, first, byArgs.Pick(PickInfo{Args: &mathArgs{A: 42, B: i}}, backends))
+	}
+
+	// Calls without a key are spread in turn.
+	assert.Equal(t, "abc", pickAddrs(byArgs, backends, 3))
+	byMetadata := ConsistentHash(MetadataKey("user"))
+	assert.Equal(t, "abc", pickAddrs(byMetadata, backends, 3))
+}
+
+func TestBalancerConsistentHash(t *testing.T) {
+	var addrs []Address
+	for _, name := range []string{"a", "b", "c"} {
+		addr, _ := startNamedServer(t, name)
+		addrs = append(addrs, Address{Addr: addr})
+	}
+	balancer := DialBalancer("tcp", addrs, WithBalancerPolicy(ConsistentHash(MetadataKey("user"))))
+	defer balancer.Close()
+	waitForBalancer(t, balancer, StateReady, addrs[0].Addr, addrs[1].Addr, addrs[2].Addr)
+
+	names := make(map[string]string)
+	for i := 0; i < 3; i++ {
+		for user := 0; user < 20; user++ {
+			ctx := AppendToOutgoingContext(context.Background(), "user", strconv.Itoa(user))
+			reply := new(rawArgs)
+			assert.NoError(t, balancer.CallContext(ctx, "Name.Get", new(rawArgs), reply))
+			if i == 0 {
+				names[strconv.Itoa(user)] = string(*reply)
+			} else {
+				assert.Equal(t, names[strconv.Itoa(user)], string(*reply))
+			}
+		}
+	}
+}
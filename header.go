@@ -2,34 +2,111 @@ package drpc
 
 import (
 	"encoding/binary"
+	"time"
 )
 
 const (
-	// MaxHeaderSize = 10 + 10 + 4 (10 refer to binary.MaxVarintLen64)
-	MaxHeaderSize = 24
+	// MaxHeaderSize = 1 + 1 + 10 + 10 + 10 + 10 + 10 + 4 (10 refer to binary.MaxVarintLen64),
+	// the fixed part of a ResponseHeader, which is larger than that of a
+	// RequestHeader (1 + 1 + 10 + 10 + 10 + 10 + 4).
+	MaxHeaderSize = 56
 
+	Uint8Size  = 1
 	Uint16Size = 2
 	Uint32Size = 4
 )
 
+// RequestType tells the server what a request frame asks for.
+type RequestType uint8
+
+const (
+	// RequestCall invokes Method. The request body follows the header.
+	RequestCall RequestType = iota
+	// RequestCancel tells the server the client has given up on the call
+	// or stream with the same ID. It is followed by an empty body.
+	RequestCancel
+	// RequestStream opens a stream to Method. It is followed by an empty
+	// body; the messages of the client travel in RequestMessage frames.
+	RequestStream
+	// RequestMessage carries one message of the client on the stream with
+	// the same ID in its body.
+	RequestMessage
+	// RequestCloseSend tells the server the client won't send any more
+	// messages on the stream with the same ID. It is followed by an empty
+	// body.
+	RequestCloseSend
+	// RequestContinuation carries the next fragment of the body of the
+	// request with the same ID. Only Flags and Checksum are used.
+	RequestContinuation
+	// RequestWindowUpdate returns credit to the server: its body holds a
+	// uvarint number of bytes the server may send on top of its window for
+	// the same ID, or for the whole connection if ID is 0.
+	RequestWindowUpdate
+)
+
+// ResponseType tells the client what a response frame carries.
+type ResponseType uint8
+
+const (
+	// ResponseReply answers a RequestCall. It carries the status of the
+	// call, and the reply follows the header.
+	ResponseReply ResponseType = iota
+	// ResponseMessage carries one message of the server on the stream with
+	// the same ID in its body.
+	ResponseMessage
+	// ResponseEnd ends the stream with the same ID. It carries the status
+	// and the metadata of the stream, and is followed by an empty body.
+	ResponseEnd
+	// ResponseContinuation carries the next fragment of the body of the
+	// response with the same ID. Only Flags and Checksum are used.
+	ResponseContinuation
+	// ResponseWindowUpdate returns credit to the client, like
+	// RequestWindowUpdate.
+	ResponseWindowUpdate
+)
+
+// Flags are the bits of the Flags field of both headers.
+type Flags uint8
+
+const (
+	// FlagMore means the body is continued by the next continuation frame
+	// with the same ID. Bodies larger than MaxFragmentSize are split this
+	// way, so that frames of other calls can be sent in between.
+	FlagMore Flags = 1 << iota
+)
+
 // RequestHeader request header structure looks like:
-// +----------+----------------+----------+
-// |    ID    |      Method    |  Checksum|
-// +----------+----------------+----------+
-// |  uvarint | uvarint+string |   uint32 |
-// +----------+----------------+----------+
+// +-------+-------+----------+----------------+----------+----------+----------+
+// |  Type | Flags |    ID    |      Method    |  Timeout | Metadata | Checksum |
+// +-------+-------+----------+----------------+----------+----------+----------+
+// | uint8 | uint8 |  uvarint | uvarint+string |  uvarint | metadata |   uint32 |
+// +-------+-------+----------+----------------+----------+----------+----------+
+// Checksum covers the body of this frame only. Timeout is the time the client
+// is still willing to wait, in nanoseconds; zero means no deadline. Metadata
+// is encoded as a uvarint count followed by that many key and value strings,
+// ordered by key.
 type RequestHeader struct {
+	Type     RequestType
+	Flags    Flags
 	ID       uint64
 	Method   string
+	Timeout  time.Duration
+	Metadata Metadata
 	Checksum uint32
 }
 
 func (r *RequestHeader) Marshal() []byte {
 	idx := 0
-	header := make([]byte, MaxHeaderSize+len(r.Method))
+	header := make([]byte, MaxHeaderSize+len(r.Method)+r.Metadata.size())
 
+	header[idx] = byte(r.Type)
+	idx += Uint8Size
+	header[idx] = byte(r.Flags)
+	idx += Uint8Size
 	idx += binary.PutUvarint(header[idx:], r.ID)
 	idx += writeString(header[idx:], r.Method)
+	idx += binary.PutUvarint(header[idx:], uint64(r.Timeout))
+	idx += writeMetadata(header[idx:], r.Metadata)
 	binary.LittleEndian.PutUint32(header[idx:], r.Checksum)
 	idx += Uint32Size
 
@@ -39,20 +116,43 @@ func (r *RequestHeader) Marshal() []byte {
 func (r *RequestHeader) Unmarshal(data []byte) error {
 	idx, size := 0, 0
 	n := len(data)
+	var err error
 
 	if idx >= n {
 		return ErrUnmarshal
 	}
-	r.ID, size = binary.Uvarint(data[idx:])
-	idx += size
+	r.Type = RequestType(data[idx])
+	idx += Uint8Size
 
 	if idx >= n {
 		return ErrUnmarshal
 	}
-	r.Method, size = readString(data[idx:])
+	r.Flags = Flags(data[idx])
+	idx += Uint8Size
+
+	if r.ID, size, err = readUvarint(data[idx:]); err != nil {
+		return err
+	}
 	idx += size
 
-	if idx >= n {
+	if r.Method, size, err = readString(data[idx:]); err != nil {
+		return err
+	}
+	idx += size
+
+	timeout, size, err := readUvarint(data[idx:])
+	if err != nil {
+		return err
+	}
+	r.Timeout = time.Duration(timeout)
+	idx += size
+
+	if r.Metadata, size, err = readMetadata(data[idx:]); err != nil {
+		return err
+	}
+	idx += size
+
+	if n-idx != Uint32Size {
 		return ErrUnmarshal
 	}
 	r.Checksum = binary.LittleEndian.Uint32(data[idx:])
@@ -61,23 +161,61 @@ func (r *RequestHeader) Unmarshal(data []byte) error {
 }
 
 // ResponseHeader request header structure looks like:
-// +---------+----------------+----------+
-// |    ID   |      Error     |  Checksum|
-// +---------+----------------+----------+
-// | uvarint | uvarint+string |   uint32 |
-// +---------+----------------+----------+
+// +-------+-------+---------+---------+----------------+---------+----------+----------+
+// |  Type | Flags |    ID   |   Code  |     Message    | Details | Metadata | Checksum |
+// +-------+-------+---------+---------+----------------+---------+----------+----------+
+// | uint8 | uint8 | uvarint | uvarint | uvarint+string | details | metadata |   uint32 |
+// +-------+-------+---------+---------+----------------+---------+----------+----------+
+// Code, Message and Details make up the status of the call; a Code of OK
+// means it succeeded. Details are encoded as a uvarint count followed by
+// that many type strings and uvarint-prefixed values.
 type ResponseHeader struct {
+	Type     ResponseType
+	Flags    Flags
 	ID       uint64
-	Error    string
+	Code     Code
+	Message  string
+	Details  []Detail
+	Metadata Metadata
 	Checksum uint32
 }
 
+// Err returns the status of the response as an *Error, or nil if the call
+// succeeded.
+func (r *ResponseHeader) Err() error {
+	if r.Code == OK {
+		return nil
+	}
+	return &Error{
+		Code:    r.Code,
+		Message: r.Message,
+		Details: r.Details,
+	}
+}
+
+// SetErr sets the status of the response from err.
+func (r *ResponseHeader) SetErr(err error) {
+	e := Convert(err)
+	if e == nil {
+		r.Code, r.Message, r.Details = OK, "", nil
+		return
+	}
+	r.Code, r.Message, r.Details = e.Code, e.Message, e.Details
+}
+
 func (r *ResponseHeader) Marshal() []byte {
 	idx := 0
-	header := make([]byte, MaxHeaderSize+len(r.Error))
+	header := make([]byte, MaxHeaderSize+len(r.Message)+detailsSize(r.Details)+r.Metadata.size())
 
+	header[idx] = byte(r.Type)
+	idx += Uint8Size
+	header[idx] = byte(r.Flags)
+	idx += Uint8Size
 	idx += binary.PutUvarint(header[idx:], r.ID)
-	idx += writeString(header[idx:], r.Error)
+	idx += binary.PutUvarint(header[idx:], uint64(r.Code))
+	idx += writeString(header[idx:], r.Message)
+	idx += writeDetails(header[idx:], r.Details)
+	idx += writeMetadata(header[idx:], r.Metadata)
 	binary.LittleEndian.PutUint32(header[idx:], r.Checksum)
 	idx += Uint32Size
 
@@ -87,20 +225,51 @@ func (r *ResponseHeader) Marshal() []byte {
 func (r *ResponseHeader) Unmarshal(data []byte) error {
 	idx, size := 0, 0
 	n := len(data)
+	var err error
 
 	if idx >= n {
 		return ErrUnmarshal
 	}
-	r.ID, size = binary.Uvarint(data[idx:])
-	idx += size
+	r.Type = ResponseType(data[idx])
+	idx += Uint8Size
 
 	if idx >= n {
 		return ErrUnmarshal
 	}
-	r.Error, size = readString(data[idx:])
+	r.Flags = Flags(data[idx])
+	idx += Uint8Size
+
+	if r.ID, size, err = readUvarint(data[idx:]); err != nil {
+		return err
+	}
 	idx += size
 
-	if idx >= n {
+	code, size, err := readUvarint(data[idx:])
+	if err != nil {
+		return err
+	}
+	if code > uint64(^Code(0)) {
+		return ErrUnmarshal
+	}
+	r.Code = Code(code)
+	idx += size
+
+	if r.Message, size, err = readString(data[idx:]); err != nil {
+		return err
+	}
+	idx += size
+
+	if r.Details, size, err = readDetails(data[idx:]); err != nil {
+		return err
+	}
+	idx += size
+
+	if r.Metadata, size, err = readMetadata(data[idx:]); err != nil {
+		return err
+	}
+	idx += size
+
+	if n-idx != Uint32Size {
 		return ErrUnmarshal
 	}
 	r.Checksum = binary.LittleEndian.Uint32(data[idx:])
@@ -108,13 +277,28 @@ func (r *ResponseHeader) Unmarshal(data []byte) error {
 	return nil
 }
 
-func readString(data []byte) (string, int) {
-	idx := 0
-	length, size := binary.Uvarint(data)
-	idx += size
-	str := string(data[idx : idx+int(length)])
-	idx += len(str)
-	return str, idx
+// The read helpers below decode a field from the start of data and return
+// it with the number of bytes it took. They never read past data and fail
+// with ErrUnmarshal instead, whatever the lengths and counts on the wire say.
+
+func readUvarint(data []byte) (uint64, int, error) {
+	v, size := binary.Uvarint(data)
+	if size <= 0 {
+		return 0, 0, ErrUnmarshal
+	}
+	return v, size, nil
+}
+
+func readString(data []byte) (string, int, error) {
+	length, size, err := readUvarint(data)
+	if err != nil {
+		return "", 0, err
+	}
+	if length > uint64(len(data)-size) {
+		return "", 0, ErrUnmarshal
+	}
+	end := size + int(length)
+	return string(data[size:end]), end, nil
 }
 
 func writeString(data []byte, str string) int {
@@ -124,3 +308,93 @@ func writeString(data []byte, str string) int {
 	idx += len(str)
 	return idx
 }
+
+func readMetadata(data []byte) (Metadata, int, error) {
+	count, idx, err := readUvarint(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if count == 0 {
+		return nil, idx, nil
+	}
+	// Each pair takes at least two bytes; don't trust count any further.
+	if count > uint64(len(data)-idx)/2 {
+		return nil, 0, ErrUnmarshal
+	}
+
+	md := make(Metadata, count)
+	for i := uint64(0); i < count; i++ {
+		key, size, err := readString(data[idx:])
+		if err != nil {
+			return nil, 0, err
+		}
+		idx += size
+		value, size, err := readString(data[idx:])
+		if err != nil {
+			return nil, 0, err
+		}
+		idx += size
+		md[key] = value
+	}
+	return md, idx, nil
+}
+
+func writeMetadata(data []byte, md Metadata) int {
+	idx := 0
+	idx += binary.PutUvarint(data, uint64(len(md)))
+	for _, key := range md.keys() {
+		idx += writeString(data[idx:], key)
+		idx += writeString(data[idx:], md[key])
+	}
+	return idx
+}
+
+func readDetails(data []byte) ([]Detail, int, error) {
+	count, idx, err := readUvarint(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if count == 0 {
+		return nil, idx, nil
+	}
+	// Each detail takes at least two bytes; don't trust count any further.
+	if count > uint64(len(data)-idx)/2 {
+		return nil, 0, ErrUnmarshal
+	}
+
+	details := make([]Detail, count)
+	for i := range details {
+		typ, size, err := readString(data[idx:])
+		if err != nil {
+			return nil, 0, err
+		}
+		idx += size
+		value, size, err := readString(data[idx:])
+		if err != nil {
+			return nil, 0, err
+		}
+		idx += size
+		details[i] = Detail{Type: typ, Value: []byte(value)}
+	}
+	return details, idx, nil
+}
+
+func writeDetails(data []byte, details []Detail) int {
+	idx := 0
+	idx += binary.PutUvarint(data, uint64(len(details)))
+	for _, d := range details {
+		idx += writeString(data[idx:], d.Type)
+		idx += writeString(data[idx:], string(d.Value))
+	}
+	return idx
+}
+
+// detailsSize returns an upper bound of the encoded size of details, minus
+// the count.
+func detailsSize(details []Detail) int {
+	n := 0
+	for _, d := range details {
+		n += 2*binary.MaxVarintLen64 + len(d.Type) + len(d.Value)
+	}
+	return n
+}
@@ -39,22 +39,101 @@ func TestResponseHeader(t *testing.T) {
 
 func GenerateRandomRequestHeader() *RequestHeader {
 	return &RequestHeader{
+		Type:     RequestType(rand.Intn(7)),
+		Flags:    Flags(rand.Intn(2)),
 		ID:       rand.Uint64(),
 		Method:   GetRandomString(),
+		Timeout:  time.Duration(rand.Int63()),
+		Metadata: GenerateRandomMetadata(),
 		Checksum: rand.Uint32(),
 	}
 }
 
 func GenerateRandomResponseHeader() *ResponseHeader {
 	return &ResponseHeader{
+		Type:     ResponseType(rand.Intn(5)),
+		Flags:    Flags(rand.Intn(2)),
 		ID:       rand.Uint64(),
-		Error:    GetRandomString(),
+		Code:     Code(rand.Intn(17)),
+		Message:  GetRandomString(),
+		Details:  GenerateRandomDetails(),
+		Metadata: GenerateRandomMetadata(),
 		Checksum: rand.Uint32(),
 	}
 }
 
+func GenerateRandomMetadata() Metadata {
+	n := rand.Intn(5)
+	if n == 0 {
+		return nil
+	}
+	md := make(Metadata, n)
+	for i := 0; i < n; i++ {
+		md[GetRandomString()] = GetRandomString()
+	}
+	return md
+}
+
+func GenerateRandomDetails() []Detail {
+	n := rand.Intn(3)
+	if n == 0 {
+		return nil
+	}
+	details := make([]Detail, n)
+	for i := range details {
+		details[i] = Detail{
+			Type:  GetRandomString(),
+			Value: []byte(GetRandomString()),
+		}
+	}
+	return details
+}
+
 func GetRandomString() string {
 	randBytes := make([]byte, rand.Intn(1000))
 	rand.Read(randBytes)
 	return fmt.Sprintf("%x", randBytes)
 }
+
+// addHeaderSeeds adds whole and truncated encodings of random headers to the
+// seed corpus of f.
+func addHeaderSeeds(f *testing.F, generate func() []byte) {
+	f.Add([]byte{})
+	for i := 0; i < 20; i++ {
+		data := generate()
+		f.Add(data)
+		f.Add(data[:rand.Intn(len(data))])
+	}
+}
+
+func FuzzRequestHeader(f *testing.F) {
+	addHeaderSeeds(f, func() []byte {
+		return GenerateRandomRequestHeader().Marshal()
+	})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		header := new(RequestHeader)
+		if err := header.Unmarshal(data); err != nil {
+			assert.ErrorIs(t, err, ErrUnmarshal)
+			return
+		}
+		again := new(RequestHeader)
+		assert.NoError(t, again.Unmarshal(header.Marshal()))
+		assert.Equal(t, header, again)
+	})
+}
+
+func FuzzResponseHeader(f *testing.F) {
+	addHeaderSeeds(f, func() []byte {
+		return GenerateRandomResponseHeader().Marshal()
+	})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		header := new(ResponseHeader)
+		if err := header.Unmarshal(data); err != nil {
+			assert.ErrorIs(t, err, ErrUnmarshal)
+			return
+		}
+		again := new(ResponseHeader)
+		assert.NoError(t, again.Unmarshal(header.Marshal()))
+		assert.Equal(t, header, again)
+	})
+}
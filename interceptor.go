@@ -0,0 +1,49 @@
+package drpc
+
+import "context"
+
+// UnaryServerInfo describes the call a UnaryServerInterceptor wraps.
+type UnaryServerInfo struct {
+	// FullMethod is the called method in the "Service.Method" form.
+	FullMethod string
+	// Header is the header the request arrived with.
+	Header *RequestHeader
+}
+
+// UnaryServerInterceptor wraps the dispatch of every request to its handler.
+// It may call handler to continue the chain, possibly changing args, the
+// reply or the error on the way, or return without calling it to
+// short-circuit the call.
+type UnaryServerInterceptor func(ctx context.Context, args []byte, info *UnaryServerInfo, handler ContextHandler) ([]byte, error)
+
+// chainUnaryServer returns a handler that runs handler behind interceptors,
+// the first interceptor being the outermost.
+func chainUnaryServer(interceptors []UnaryServerInterceptor, info *UnaryServerInfo, handler ContextHandler) ContextHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, args []byte) ([]byte, error) {
+			return interceptor(ctx, args, info, next)
+		}
+	}
+	return handler
+}
+
+// UnaryInvoker sends a request and waits for its response, filling reply.
+type UnaryInvoker func(ctx context.Context, serviceMethod string, args, reply Serializer) error
+
+// UnaryClientInterceptor wraps every call made through a Client. It sees the
+// method, args and reply, can time the call and inspect or replace its error.
+// It may call invoker any number of times, e.g. to retry, or not at all.
+type UnaryClientInterceptor func(ctx context.Context, serviceMethod string, args, reply Serializer, invoker UnaryInvoker) error
+
+// chainUnaryClient returns an invoker that runs invoker behind interceptors,
+// the first interceptor being the outermost.
+func chainUnaryClient(interceptors []UnaryClientInterceptor, invoker UnaryInvoker) UnaryInvoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, serviceMethod string, args, reply Serializer) error {
+			return interceptor(ctx, serviceMethod, args, reply, next)
+		}
+	}
+	return invoker
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"net"
 )
 
 func sendFrame(w io.Writer, data []byte) (err error) {
@@ -29,11 +28,50 @@ func sendFrame(w io.Writer, data []byte) (err error) {
 	return
 }
 
-func recvFrame(r io.Reader) (data []byte, err error) {
+// Limits bound what a peer may send, so that a malformed or hostile frame
+// can't make the process allocate arbitrary amounts of memory.
+type Limits struct {
+	// MaxHeaderSize is the size of the largest header frame accepted.
+	MaxHeaderSize int
+	// MaxBodySize is the size of the largest body accepted, whether it
+	// arrives in a single frame or in fragments.
+	MaxBodySize int
+}
+
+// DefaultLimits are the Limits of the codecs made by NewClientCodec and
+// NewServerCodec.
+var DefaultLimits = Limits{
+	MaxHeaderSize: 64 << 10,
+	MaxBodySize:   4 << 20,
+}
+
+// withDefaults fills in the zero fields of l from DefaultLimits.
+func (l Limits) withDefaults() Limits {
+	if l.MaxHeaderSize <= 0 {
+		l.MaxHeaderSize = DefaultLimits.MaxHeaderSize
+	}
+	if l.MaxBodySize <= 0 {
+		l.MaxBodySize = DefaultLimits.MaxBodySize
+	}
+	return l
+}
+
+// errTooLarge is the error for a body or frame of size bytes that exceeds
+// limit.
+func errTooLarge(what string, size uint64, limit int) error {
+	return Errorf(ResourceExhausted, "%s of %d bytes exceeds the limit of %d bytes", what, size, limit)
+}
+
+// recvFrame reads a frame of at most limit bytes. A larger frame is rejected
+// with a ResourceExhausted error before its buffer is allocated.
+func recvFrame(r io.Reader, limit int) (data []byte, err error) {
 	size, err := binary.ReadUvarint(r.(io.ByteReader))
 	if err != nil {
 		return nil, err
 	}
+	if size > uint64(limit) {
+		return nil, errTooLarge("frame", size, limit)
+	}
 	if size != 0 {
 		data = make([]byte, size)
 		n, err := io.ReadFull(r, data)
@@ -50,7 +88,7 @@ func recvFrame(r io.Reader) (data []byte, err error) {
 func write(w io.Writer, data []byte) error {
 	for index := 0; index < len(data); {
 		n, err := w.Write(data[index:])
-		if _, ok := err.(net.Error); !ok {
+		if err != nil {
 			return err
 		}
 		index += n
@@ -0,0 +1,47 @@
+package drpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecvFrameLimit(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, sendFrame(&buf, []byte("hello")))
+	data, err := recvFrame(bufio.NewReader(&buf), 5)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	// Only the size is sent: the frame must be rejected before its buffer
+	// is allocated, or this test would run out of memory.
+	size := make([]byte, binary.MaxVarintLen64)
+	buf.Write(size[:binary.PutUvarint(size, 1<<50)])
+	_, err = recvFrame(bufio.NewReader(&buf), DefaultLimits.MaxBodySize)
+	assert.Equal(t, ResourceExhausted, CodeOf(err))
+}
+
+func FuzzRecvFrame(f *testing.F) {
+	for i := 0; i < 20; i++ {
+		var buf bytes.Buffer
+		sendFrame(&buf, GenerateRandomRequestHeader().Marshal())
+		sendFrame(&buf, []byte(GetRandomString()))
+		f.Add(buf.Bytes())
+		f.Add(buf.Bytes()[:rand.Intn(buf.Len())])
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		limit := DefaultLimits.MaxHeaderSize
+		r := bufio.NewReader(bytes.NewReader(data))
+		for {
+			frame, err := recvFrame(r, limit)
+			if err != nil {
+				return
+			}
+			assert.LessOrEqual(t, len(frame), limit)
+		}
+	})
+}
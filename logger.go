@@ -0,0 +1,75 @@
+package drpc
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+)
+
+// Level is the severity of a log entry.
+type Level int8
+
+const (
+	// LevelDebug is for events that are expected on a busy connection, like
+	// a write failing because the peer went away.
+	LevelDebug Level = iota
+	// LevelInfo is for notable but normal events.
+	LevelInfo
+	// LevelWarn is for events that may need attention, like a connection
+	// that broke or a client that was rejected.
+	LevelWarn
+	// LevelError is for bugs, like a handler that panicked.
+	LevelError
+)
+
+var levelNames = [...]string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+func (l Level) String() string {
+	if l >= 0 && int(l) < len(levelNames) {
+		return levelNames[l]
+	}
+	return "Level(" + strconv.Itoa(int(l)) + ")"
+}
+
+// Logger receives the log entries of clients and servers. keyvals holds
+// alternating keys and values, like "err", err. A Logger must be safe for
+// concurrent use.
+type Logger interface {
+	Log(level Level, msg string, keyvals ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(Level, string, ...interface{}) {}
+
+// NopLogger returns a Logger that discards everything. Clients and servers
+// use it unless told otherwise.
+func NopLogger() Logger {
+	return nopLogger{}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlogLogger returns a Logger that writes to l.
+func NewSlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+func (s slogLogger) Log(level Level, msg string, keyvals ...interface{}) {
+	s.l.Log(context.Background(), slogLevel(level), msg, keyvals...)
+}
+
+func slogLevel(level Level) slog.Level {
+	switch level {
+	case LevelDebug:
+		return slog.LevelDebug
+	case LevelInfo:
+		return slog.LevelInfo
+	case LevelWarn:
+		return slog.LevelWarn
+	default:
+		return slog.LevelError
+	}
+}
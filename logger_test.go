@@ -0,0 +1,38 @@
+package drpc
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	handler := slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	logger := NewSlogLogger(slog.New(handler))
+
+	logger.Log(LevelDebug, "debug", "id", 1)
+	logger.Log(LevelInfo, "info")
+	logger.Log(LevelWarn, "warn", "err", "boom")
+	logger.Log(LevelError, "error", "method", "Math.Add")
+	assert.Equal(t, "level=DEBUG msg=debug id=1\n"+
+		"level=INFO msg=info\n"+
+		"level=WARN msg=warn err=boom\n"+
+		"level=ERROR msg=error method=Math.Add\n", buf.String())
+}
+
+func TestNopLogger(t *testing.T) {
+	NopLogger().Log(LevelError, "dropped", "key", "value")
+	assert.Equal(t, "WARN", LevelWarn.String())
+	assert.Equal(t, "Level(7)", Level(7).String())
+}
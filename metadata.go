@@ -0,0 +1,135 @@
+package drpc
+
+import (
+	"context"
+	"encoding/binary"
+	"sort"
+	"sync"
+)
+
+// Metadata is a set of key/value pairs sent along with a request or a
+// response, for things like trace IDs, auth tokens or server timing, that
+// don't belong in the message itself.
+type Metadata map[string]string
+
+// Get returns the value for key, or "" if there is none.
+func (md Metadata) Get(key string) string {
+	return md[key]
+}
+
+// Set sets the value for key.
+func (md Metadata) Set(key, value string) {
+	md[key] = value
+}
+
+// Copy returns a copy of md.
+func (md Metadata) Copy() Metadata {
+	if md == nil {
+		return nil
+	}
+	out := make(Metadata, len(md))
+	for k, v := range md {
+		out[k] = v
+	}
+	return out
+}
+
+func (md Metadata) keys() []string {
+	keys := make([]string, 0, len(md))
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// size returns an upper bound of the encoded size of md, minus the count.
+func (md Metadata) size() int {
+	n := 0
+	for k, v := range md {
+		n += 2*binary.MaxVarintLen64 + len(k) + len(v)
+	}
+	return n
+}
+
+type (
+	outgoingMetadataKey struct{}
+	incomingMetadataKey struct{}
+	responseMetadataKey struct{}
+	capturedMetadataKey struct{}
+)
+
+// NewOutgoingContext returns a copy of ctx whose calls send md along with the
+// request. It replaces any metadata already attached to ctx.
+func NewOutgoingContext(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, outgoingMetadataKey{}, md)
+}
+
+// AppendToOutgoingContext returns a copy of ctx with the given key/value
+// pairs added to its outgoing metadata. kv must have an even length.
+func AppendToOutgoingContext(ctx context.Context, kv ...string) context.Context {
+	if len(kv)%2 == 1 {
+		panic("drpc: AppendToOutgoingContext got an odd number of arguments")
+	}
+	md := OutgoingMetadata(ctx).Copy()
+	if md == nil {
+		md = make(Metadata, len(kv)/2)
+	}
+	for i := 0; i < len(kv); i += 2 {
+		md[kv[i]] = kv[i+1]
+	}
+	return NewOutgoingContext(ctx, md)
+}
+
+// OutgoingMetadata returns the metadata calls made with ctx send, or nil.
+func OutgoingMetadata(ctx context.Context) Metadata {
+	md, _ := ctx.Value(outgoingMetadataKey{}).(Metadata)
+	return md
+}
+
+// IncomingMetadata returns the metadata the client sent with the request
+// being handled, or nil.
+func IncomingMetadata(ctx context.Context) Metadata {
+	md, _ := ctx.Value(incomingMetadataKey{}).(Metadata)
+	return md
+}
+
+// SetResponseMetadata sets a key/value pair the server sends back with the
+// response to the request being handled. It reports false if ctx is not the
+// context of a request.
+func SetResponseMetadata(ctx context.Context, key, value string) bool {
+	rm, ok := ctx.Value(responseMetadataKey{}).(*responseMetadata)
+	if !ok {
+		return false
+	}
+	rm.set(key, value)
+	return true
+}
+
+// CaptureResponseMetadata returns a copy of ctx whose calls store the
+// metadata of their response in *md.
+func CaptureResponseMetadata(ctx context.Context, md *Metadata) context.Context {
+	return context.WithValue(ctx, capturedMetadataKey{}, md)
+}
+
+// responseMetadata collects the metadata of a response while its handler
+// runs.
+type responseMetadata struct {
+	mu sync.Mutex
+	md Metadata
+}
+
+func (rm *responseMetadata) set(key, value string) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if rm.md == nil {
+		rm.md = make(Metadata)
+	}
+	rm.md[key] = value
+}
+
+func (rm *responseMetadata) get() Metadata {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	return rm.md.Copy()
+}
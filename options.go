@@ -0,0 +1,193 @@
+package drpc
+
+import (
+	"crypto/tls"
+	"io"
+	"time"
+)
+
+// ServerOption configures a Server made by NewServer.
+type ServerOption func(*serverOptions)
+
+type serverOptions struct {
+	maxConcurrent int
+	limits        Limits
+	interceptors  []UnaryServerInterceptor
+	logger        Logger
+	panicHook     PanicHook
+	codec         func(conn io.ReadWriteCloser) ServerCodec
+	tlsConfig     *tls.Config
+}
+
+func defaultServerOptions() serverOptions {
+	return serverOptions{
+		maxConcurrent: DefaultMaxConcurrentRequests,
+		limits:        DefaultLimits,
+		logger:        NopLogger(),
+	}
+}
+
+// WithMaxConcurrentRequests limits how many handlers may run at once for a
+// single connection. Further requests wait for a running one to finish,
+// holding back the connection window of their bodies meanwhile; once a
+// thousand of them wait, more fail with ResourceExhausted.
+func WithMaxConcurrentRequests(n int) ServerOption {
+	return func(o *serverOptions) {
+		if n < 1 {
+			n = 1
+		}
+		o.maxConcurrent = n
+	}
+}
+
+// WithServerLimits bounds the size of the requests the server accepts. Zero
+// fields keep their default.
+func WithServerLimits(limits Limits) ServerOption {
+	return func(o *serverOptions) {
+		o.limits = limits.withDefaults()
+	}
+}
+
+// WithServerInterceptors appends interceptors to the chain that wraps every
+// handler dispatch. Interceptors run in the order they were given.
+func WithServerInterceptors(interceptors ...UnaryServerInterceptor) ServerOption {
+	return func(o *serverOptions) {
+		o.interceptors = append(o.interceptors, interceptors...)
+	}
+}
+
+// WithServerLogger sets the logger of the server; nil discards the log,
+// which is the default.
+func WithServerLogger(l Logger) ServerOption {
+	return func(o *serverOptions) {
+		if l == nil {
+			l = NopLogger()
+		}
+		o.logger = l
+	}
+}
+
+// WithPanicHook sets a hook that is called for every handler panic.
+func WithPanicHook(hook PanicHook) ServerOption {
+	return func(o *serverOptions) {
+		o.panicHook = hook
+	}
+}
+
+// WithServerCodec makes ServeConn and Serve use the codecs newCodec returns
+// instead of the default one. The limits of WithServerLimits then only apply
+// to bodies assembled from fragments.
+func WithServerCodec(newCodec func(conn io.ReadWriteCloser) ServerCodec) ServerOption {
+	return func(o *serverOptions) {
+		o.codec = newCodec
+	}
+}
+
+// WithTLSConfig makes Serve wrap its listener with crypto/tls using config.
+// Set config.ClientAuth to tls.RequireAndVerifyClientCert for mutual TLS;
+// handlers find the client's certificate through PeerFromContext.
+func WithTLSConfig(config *tls.Config) ServerOption {
+	return func(o *serverOptions) {
+		o.tlsConfig = config
+	}
+}
+
+// DialOption configures a Client made by NewClient or Dial.
+type DialOption func(*dialOptions)
+
+type dialOptions struct {
+	limits       Limits
+	interceptors []UnaryClientInterceptor
+	logger       Logger
+	codec        func(conn io.ReadWriteCloser) ClientCodec
+	timeout      time.Duration
+	backoff      Backoff
+	waitForReady bool
+	poolPolicy   PoolPolicy
+	policy       Policy
+}
+
+func defaultDialOptions() dialOptions {
+	return dialOptions{
+		limits:  DefaultLimits,
+		logger:  NopLogger(),
+		backoff: DefaultBackoff,
+	}
+}
+
+// WithClientLimits bounds the size of the responses the client accepts. Zero
+// fields keep their default.
+func WithClientLimits(limits Limits) DialOption {
+	return func(o *dialOptions) {
+		o.limits = limits.withDefaults()
+	}
+}
+
+// WithClientInterceptors appends interceptors to the chain that wraps every
+// call made through the client. Interceptors run in the order they were
+// given.
+func WithClientInterceptors(interceptors ...UnaryClientInterceptor) DialOption {
+	return func(o *dialOptions) {
+		o.interceptors = append(o.interceptors, interceptors...)
+	}
+}
+
+// WithClientLogger sets the logger of the client; nil discards the log,
+// which is the default.
+func WithClientLogger(l Logger) DialOption {
+	return func(o *dialOptions) {
+		if l == nil {
+			l = NopLogger()
+		}
+		o.logger = l
+	}
+}
+
+// WithClientCodec makes the client use the codec newCodec returns instead of
+// the default one. The limits of WithClientLimits then only apply to bodies
+// assembled from fragments.
+func WithClientCodec(newCodec func(conn io.ReadWriteCloser) ClientCodec) DialOption {
+	return func(o *dialOptions) {
+		o.codec = newCodec
+	}
+}
+
+// WithDialTimeout bounds how long Dial waits for the connection to be
+// established.
+func WithDialTimeout(d time.Duration) DialOption {
+	return func(o *dialOptions) {
+		o.timeout = d
+	}
+}
+
+// WithBackoff sets how long a ReconnectingClient waits between failed dials.
+func WithBackoff(b Backoff) DialOption {
+	return func(o *dialOptions) {
+		o.backoff = b
+	}
+}
+
+// WithWaitForReady makes the calls of a ReconnectingClient wait for a
+// connection while dialing fails, instead of failing with ErrUnavailable.
+// They still give up when their context is done.
+func WithWaitForReady(wait bool) DialOption {
+	return func(o *dialOptions) {
+		o.waitForReady = wait
+	}
+}
+
+// WithPoolPolicy sets how a Pool picks the member that takes a call. The
+// default is PickLeastPending.
+func WithPoolPolicy(policy PoolPolicy) DialOption {
+	return func(o *dialOptions) {
+		o.poolPolicy = policy
+	}
+}
+
+// WithBalancerPolicy sets how a Balancer picks the backend of a call. The
+// default is RoundRobin.
+func WithBalancerPolicy(policy Policy) DialOption {
+	return func(o *dialOptions) {
+		o.policy = policy
+	}
+}
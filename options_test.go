@@ -0,0 +1,64 @@
+package drpc
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type countingServerCodec struct {
+	ServerCodec
+	requests *int32
+}
+
+func (c countingServerCodec) ReadRequestHeader(req *RequestHeader) error {
+	err := c.ServerCodec.ReadRequestHeader(req)
+	if err == nil {
+		atomic.AddInt32(c.requests, 1)
+	}
+	return err
+}
+
+type countingClientCodec struct {
+	ClientCodec
+	responses *int32
+}
+
+func (c countingClientCodec) ReadResponseHeader(resp *ResponseHeader) error {
+	err := c.ClientCodec.ReadResponseHeader(resp)
+	if err == nil {
+		atomic.AddInt32(c.responses, 1)
+	}
+	return err
+}
+
+func TestCodecOptions(t *testing.T) {
+	var requests, responses int32
+	server := NewServer(WithServerCodec(func(conn io.ReadWriteCloser) ServerCodec {
+		return countingServerCodec{newServerCodec(conn, DefaultLimits), &requests}
+	}))
+	client, err := Dial("tcp", serveSleep(t, server), WithClientCodec(func(conn io.ReadWriteCloser) ClientCodec {
+		return countingClientCodec{newClientCodec(conn, DefaultLimits), &responses}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	reply := new(mathReply)
+	assert.NoError(t, client.Call("Sleep.Sleep", &mathArgs{A: 1}, reply))
+	assert.Equal(t, 1, reply.C)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&responses))
+}
+
+func TestDialTimeout(t *testing.T) {
+	// 192.0.2.0/24 is reserved for documentation, so nothing answers there.
+	start := time.Now()
+	_, err := Dial("tcp", "192.0.2.1:8888", WithDialTimeout(50*time.Millisecond))
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+}
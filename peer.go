@@ -0,0 +1,48 @@
+package drpc
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds how long ServeConn waits for a client to finish
+// the TLS handshake.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// Peer describes the client on the other end of a connection.
+type Peer struct {
+	Addr net.Addr
+	// TLS is the state of the TLS connection, or nil if the connection isn't
+	// encrypted. With mutual TLS, TLS.PeerCertificates[0] is the verified
+	// certificate of the client.
+	TLS *tls.ConnectionState
+}
+
+type peerKey struct{}
+
+// PeerFromContext returns the peer that sent the request ctx belongs to. It
+// reports false for connections served by ServeCodec, whose peer is unknown.
+func PeerFromContext(ctx context.Context) (*Peer, bool) {
+	p, ok := ctx.Value(peerKey{}).(*Peer)
+	return p, ok
+}
+
+// handshake finishes the TLS handshake of conn, if it's a TLS connection, and
+// returns its peer.
+func handshake(conn net.Conn) (*Peer, error) {
+	p := &Peer{Addr: conn.RemoteAddr()}
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return p, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	state := tc.ConnectionState()
+	p.TLS = &state
+	return p, nil
+}
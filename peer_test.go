@@ -0,0 +1,213 @@
+package drpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testPKI is a CA and the certificates it issued, all generated in-process.
+type testPKI struct {
+	pool   *x509.CertPool
+	server tls.Certificate
+	client tls.Certificate
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "drpc test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issue := func(serial int64, name string, usage x509.ExtKeyUsage) tls.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return &testPKI{
+		pool:   pool,
+		server: issue(2, "server", x509.ExtKeyUsageServerAuth),
+		client: issue(3, "alice", x509.ExtKeyUsageClientAuth),
+	}
+}
+
+// startTLSServer starts a server with config whose "Peer.Name" method replies
+// with the common name of the client certificate, or "" if there is none.
+func startTLSServer(t *testing.T, config *tls.Config) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(WithTLSConfig(config))
+	RegisterServiceContext(server, "Peer.Name", func(ctx context.Context, req []byte) ([]byte, error) {
+		p, ok := PeerFromContext(ctx)
+		if !ok || p.TLS == nil {
+			return nil, Errorf(Unauthenticated, "not a TLS connection")
+		}
+		if len(p.TLS.PeerCertificates) == 0 {
+			return nil, nil
+		}
+		return []byte(p.TLS.PeerCertificates[0].Subject.CommonName), nil
+	})
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return listener.Addr().String()
+}
+
+func TestTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	addr := startTLSServer(t, &tls.Config{Certificates: []tls.Certificate{pki.server}})
+
+	client, err := DialTLS("tcp", addr, &tls.Config{RootCAs: pki.pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	reply := new(rawArgs)
+	assert.NoError(t, client.Call("Peer.Name", new(rawArgs), reply))
+	assert.Empty(t, *reply)
+
+	// A client that doesn't trust the server's CA refuses to talk to it.
+	_, err = DialTLS("tcp", addr, &tls.Config{})
+	assert.Error(t, err)
+}
+
+func TestMutualTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	addr := startTLSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{pki.server},
+		ClientCAs:    pki.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+
+	client, err := DialTLS("tcp", addr, &tls.Config{
+		RootCAs:      pki.pool,
+		Certificates: []tls.Certificate{pki.client},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	reply := new(rawArgs)
+	assert.NoError(t, client.Call("Peer.Name", new(rawArgs), reply))
+	assert.Equal(t, "alice", string(*reply))
+
+	// Without a certificate the server hangs up. With TLS 1.3 the client
+	// only learns about it once it reads.
+	anonymous, err := DialTLS("tcp", addr, &tls.Config{RootCAs: pki.pool})
+	if err == nil {
+		defer anonymous.Close()
+		err = anonymous.Call("Peer.Name", new(rawArgs), new(rawArgs))
+	}
+	assert.Error(t, err)
+}
+
+func TestPeerWithoutTLS(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer()
+	RegisterServiceContext(server, "Peer.Addr", func(ctx context.Context, req []byte) ([]byte, error) {
+		p, ok := PeerFromContext(ctx)
+		if !ok || p.TLS != nil {
+			return nil, Errorf(Internal, "unexpected peer %v", p)
+		}
+		return []byte(p.Addr.String()), nil
+	})
+	go server.Serve(listener)
+	defer server.Close()
+
+	client, err := Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	reply := new(rawArgs)
+	assert.NoError(t, client.Call("Peer.Addr", new(rawArgs), reply))
+	assert.Contains(t, string(*reply), "127.0.0.1:")
+}
+
+func TestCloseStalledHandshake(t *testing.T) {
+	pki := newTestPKI(t)
+	for _, name := range []string{"Close", "Shutdown"} {
+		t.Run(name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := NewServer(WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{pki.server}}))
+			go server.Serve(listener)
+			defer server.Close()
+
+			// Connect but never start the handshake.
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			assert.Eventually(t, func() bool {
+				server.mu.Lock()
+				defer server.mu.Unlock()
+				return len(server.handshakes) == 1
+			}, time.Second, time.Millisecond)
+
+			if name == "Close" {
+				assert.NoError(t, server.Close())
+			} else {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				assert.NoError(t, server.Shutdown(ctx))
+			}
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = conn.Read(make([]byte, 1))
+			assert.NotErrorIs(t, err, os.ErrDeadlineExceeded)
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package drpc
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// PickInfo describes the call a Policy picks a backend for.
+type PickInfo struct {
+	Ctx           context.Context
+	ServiceMethod string
+	Args          Serializer // nil for Balancer.NewStream
+}
+
+// Policy picks the backend of each call of a Balancer. Pick gets the backends
+// that are connected, sorted by address, and at least one of them. Returning
+// nil makes the call behave as if none was connected. A Policy must be safe
+// for concurrent use.
+type Policy interface {
+	Pick(info PickInfo, backends []*Backend) *Backend
+}
+
+type roundRobin struct {
+	next uint32
+}
+
+// RoundRobin returns a Policy that picks the backends in turn.
+func RoundRobin() Policy {
+	return new(roundRobin)
+}
+
+func (p *roundRobin) Pick(_ PickInfo, backends []*Backend) *Backend {
+	n := atomic.AddUint32(&p.next, 1) - 1
+	return backends[n%uint32(len(backends))]
+}
+
+type powerOfTwoChoices struct{}
+
+// PowerOfTwoChoices returns a Policy that picks two backends at random and
+// takes the one with fewer calls in flight. It avoids busy backends almost as
+// well as always taking the least loaded one, without sending every call to
+// the same backend at once.
+func PowerOfTwoChoices() Policy {
+	return powerOfTwoChoices{}
+}
+
+func (powerOfTwoChoices) Pick(_ PickInfo, backends []*Backend) *Backend {
+	if len(backends) == 1 {
+		return backends[0]
+	}
+	i := rand.Intn(len(backends))
+	j := rand.Intn(len(backends) - 1)
+	if j >= i {
+		j++
+	}
+	if backends[j].Pending() < backends[i].Pending() {
+		return backends[j]
+	}
+	return backends[i]
+}
+
+type weighted struct {
+	mu      sync.Mutex
+	current map[string]int // by address
+}
+
+// Weighted returns a Policy that picks each backend in proportion to its
+// Weight. It interleaves the backends smoothly, so that a heavy backend
+// doesn't get all its calls in a row.
+func Weighted() Policy {
+	return &weighted{current: make(map[string]int)}
+}
+
+func (p *weighted) Pick(_ PickInfo, backends []*Backend) *Backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Drop the backends that went away.
+	if len(p.current) > len(backends) {
+		current := make(map[string]int, len(backends))
+		for _, be := range backends {
+			current[be.Addr] = p.current[be.Addr]
+		}
+		p.current = current
+	}
+
+	var best *Backend
+	total := 0
+	for _, be := range backends {
+		w := be.weight()
+		total += w
+		p.current[be.Addr] += w
+		if best == nil || p.current[be.Addr] > p.current[best.Addr] {
+			best = be
+		}
+	}
+	p.current[best.Addr] -= total
+	return best
+}
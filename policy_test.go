@@ -0,0 +1,52 @@
+package drpc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testBackends(weights ...int) []*Backend {
+	var backends []*Backend
+	for i, w := range weights {
+		backends = append(backends, &Backend{
+			Address: Address{Addr: string(rune('a' + i)), Weight: w},
+			conn:    new(clientConn),
+		})
+	}
+	return backends
+}
+
+func pickAddrs(p Policy, backends []*Backend, n int) string {
+	picked := ""
+	for i := 0; i < n; i++ {
+		picked += p.Pick(PickInfo{}, backends).Addr
+	}
+	return picked
+}
+
+func TestRoundRobin(t *testing.T) {
+	backends := testBackends(1, 1, 1)
+	assert.Equal(t, "abcabca", pickAddrs(RoundRobin(), backends, 7))
+}
+
+func TestWeighted(t *testing.T) {
+	backends := testBackends(5, 1, 1)
+	p := Weighted()
+	// The heavy backend is spread out instead of taking five calls in a row.
+	assert.Equal(t, "aabacaa"+"aabacaa", pickAddrs(p, backends, 14))
+
+	// Zero weights count as one, and a backend that went away is forgotten.
+	assert.Equal(t, "abab", pickAddrs(p, testBackends(0, 1), 4))
+}
+
+func TestPowerOfTwoChoices(t *testing.T) {
+	backends := testBackends(1, 1, 1)
+	backends[1].conn.pending = 10
+	picked := pickAddrs(PowerOfTwoChoices(), backends, 100)
+	assert.NotContains(t, picked, "b")
+	assert.Contains(t, picked, "a")
+	assert.Contains(t, picked, "c")
+
+	assert.Equal(t, "bb", pickAddrs(PowerOfTwoChoices(), backends[1:2], 2))
+}
@@ -0,0 +1,188 @@
+package drpc
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+)
+
+// PoolPolicy says which member of a Pool takes a call.
+type PoolPolicy int
+
+const (
+	// PickLeastPending picks the member with the fewest calls and streams in
+	// flight.
+	PickLeastPending PoolPolicy = iota
+	// PickRoundRobin picks the members in turn.
+	PickRoundRobin
+)
+
+var poolPolicyNames = [...]string{"LeastPending", "RoundRobin"}
+
+func (p PoolPolicy) String() string {
+	if p >= 0 && int(p) < len(poolPolicyNames) {
+		return poolPolicyNames[p]
+	}
+	return "PoolPolicy(" + strconv.Itoa(int(p)) + ")"
+}
+
+// DefaultPoolSize is the number of connections of a Pool made with a size
+// below one.
+const DefaultPoolSize = 4
+
+// Pool spreads calls over several connections to the same server, so that
+// they aren't all serialized on one connection. Each member is a
+// ReconnectingClient, so a broken connection is replaced in the background
+// while the other members take the calls. Members that aren't ready are only
+// picked if no member is.
+type Pool struct {
+	policy  PoolPolicy
+	members []*clientConn
+	next    uint32 // where the next pick starts
+}
+
+// clientConn is a ReconnectingClient that counts the calls and streams in
+// flight on it.
+type clientConn struct {
+	client  *ReconnectingClient
+	pending int64
+}
+
+func (c *clientConn) load() int64 {
+	return atomic.LoadInt64(&c.pending)
+}
+
+// invoke is like ReconnectingClient.invoke.
+func (c *clientConn) invoke(call *Call) {
+	atomic.AddInt64(&c.pending, 1)
+	defer atomic.AddInt64(&c.pending, -1)
+	c.client.invoke(call)
+}
+
+// start makes call in the background. Unlike with invoke, the call counts as
+// pending as soon as start returns.
+func (c *clientConn) start(call *Call) {
+	atomic.AddInt64(&c.pending, 1)
+	go func() {
+		c.client.invoke(call)
+		atomic.AddInt64(&c.pending, -1)
+		call.done()
+	}()
+}
+
+// track counts s as pending until it ends.
+func (c *clientConn) track(s *ClientStream, err error) (*ClientStream, error) {
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&c.pending, 1)
+	go func() {
+		<-s.finished
+		atomic.AddInt64(&c.pending, -1)
+	}()
+	return s, nil
+}
+
+// DialPool returns a Pool of size connections to address, each dialed with
+// Dial and opts. Like DialReconnecting, it dials in the background.
+func DialPool(network, address string, size int, opts ...DialOption) *Pool {
+	return NewPool(size, func() (*Client, error) {
+		return Dial(network, address, opts...)
+	}, opts...)
+}
+
+// NewPool returns a Pool of size connections, each made by dial. opts
+// configure the members like they do for NewReconnectingClient, and
+// WithPoolPolicy picks the policy.
+func NewPool(size int, dial func() (*Client, error), opts ...DialOption) *Pool {
+	o := defaultDialOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if size < 1 {
+		size = DefaultPoolSize
+	}
+	p := &Pool{policy: o.poolPolicy}
+	for i := 0; i < size; i++ {
+		p.members = append(p.members, &clientConn{
+			client: NewReconnectingClient(dial, opts...),
+		})
+	}
+	return p
+}
+
+// pick returns the member that takes the next call.
+func (p *Pool) pick() *clientConn {
+	start := int(atomic.AddUint32(&p.next, 1) % uint32(len(p.members)))
+	var best *clientConn
+	bestReady := false
+	for i := range p.members {
+		m := p.members[(start+i)%len(p.members)]
+		ready := m.client.State() == StateReady
+		if best != nil {
+			if bestReady && !ready {
+				continue
+			}
+			if ready == bestReady && (p.policy == PickRoundRobin || m.load() >= best.load()) {
+				continue
+			}
+		}
+		best, bestReady = m, ready
+	}
+	return best
+}
+
+// States returns the connectivity state of each member.
+func (p *Pool) States() []ConnState {
+	states := make([]ConnState, len(p.members))
+	for i, m := range p.members {
+		states[i] = m.client.State()
+	}
+	return states
+}
+
+func (p *Pool) Call(serviceMethod string, args, reply Serializer) error {
+	return p.CallContext(context.Background(), serviceMethod, args, reply)
+}
+
+// CallContext is like Client.CallContext, over a member picked by the policy.
+func (p *Pool) CallContext(ctx context.Context, serviceMethod string, args, reply Serializer) error {
+	call := <-p.GoContext(ctx, serviceMethod, args, reply).Done
+	return call.Error
+}
+
+func (p *Pool) Go(serviceMethod string, args, reply Serializer) *Call {
+	return p.GoContext(context.Background(), serviceMethod, args, reply)
+}
+
+// GoContext is like Client.GoContext, over a member picked by the policy.
+func (p *Pool) GoContext(ctx context.Context, serviceMethod string, args, reply Serializer) *Call {
+	call := NewCall(serviceMethod, args, reply)
+	call.ctx = ctx
+	p.pick().start(call)
+	return call
+}
+
+// CallStream is like Client.CallStream, over a member picked by the policy.
+func (p *Pool) CallStream(ctx context.Context, serviceMethod string, args Serializer) (*ClientStream, error) {
+	m := p.pick()
+	return m.track(m.client.CallStream(ctx, serviceMethod, args))
+}
+
+// NewStream is like Client.NewStream, over a member picked by the policy.
+func (p *Pool) NewStream(ctx context.Context, serviceMethod string) (*ClientStream, error) {
+	m := p.pick()
+	return m.track(m.client.NewStream(ctx, serviceMethod))
+}
+
+// Close closes all members. Calls waiting for a connection fail with
+// ErrShutdown.
+func (p *Pool) Close() error {
+	var err error
+	for _, m := range p.members {
+		if cerr := m.client.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
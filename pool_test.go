@@ -0,0 +1,109 @@
+package drpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startPeerServer starts a server whose "Peer.Addr" method sleeps for args.A
+// milliseconds and then replies with the address of the client.
+func startPeerServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer()
+	RegisterServiceContext(server, "Peer.Addr", func(ctx context.Context, req []byte) ([]byte, error) {
+		args := new(mathArgs)
+		if err := args.Unmarshal(req); err != nil {
+			return nil, err
+		}
+		time.Sleep(time.Duration(args.A) * time.Millisecond)
+		p, _ := PeerFromContext(ctx)
+		return []byte(p.Addr.String()), nil
+	})
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return listener.Addr().String()
+}
+
+func waitForPool(t *testing.T, p *Pool) {
+	for _, m := range p.members {
+		waitForState(t, m.client, StateReady)
+	}
+}
+
+func peerAddr(t *testing.T, p *Pool, delay int) string {
+	reply := new(rawArgs)
+	assert.NoError(t, p.Call("Peer.Addr", &mathArgs{A: delay}, reply))
+	return string(*reply)
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	p := DialPool("tcp", startPeerServer(t), 4, WithPoolPolicy(PickRoundRobin))
+	defer p.Close()
+	waitForPool(t, p)
+
+	counts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		counts[peerAddr(t, p, 0)]++
+	}
+	assert.Len(t, counts, 4)
+	for addr, n := range counts {
+		assert.Equal(t, 2, n, addr)
+	}
+}
+
+func TestPoolLeastPending(t *testing.T) {
+	p := DialPool("tcp", startPeerServer(t), 4)
+	defer p.Close()
+	waitForPool(t, p)
+
+	// Each slow call occupies a member, so the calls all go to different
+	// connections.
+	var calls []*Call
+	for i := 0; i < 3; i++ {
+		calls = append(calls, p.Go("Peer.Addr", &mathArgs{A: 100}, new(rawArgs)))
+	}
+	addrs := map[string]bool{peerAddr(t, p, 0): true}
+	for _, call := range calls {
+		<-call.Done
+		assert.NoError(t, call.Error)
+		addrs[string(*call.Reply.(*rawArgs))] = true
+	}
+	assert.Len(t, addrs, 4)
+}
+
+func TestPoolReplacesBrokenMember(t *testing.T) {
+	p := DialPool("tcp", startPeerServer(t), 2, WithBackoff(testBackoff))
+	defer p.Close()
+	waitForPool(t, p)
+
+	broken := p.members[0].client
+	broken.mu.Lock()
+	old := broken.client
+	broken.mu.Unlock()
+	old.Close()
+
+	// The other member takes the calls meanwhile.
+	for i := 0; i < 4; i++ {
+		peerAddr(t, p, 0)
+	}
+	for deadline := time.Now().Add(time.Second); ; {
+		broken.mu.Lock()
+		replaced := broken.client != nil && broken.client != old
+		broken.mu.Unlock()
+		if replaced {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the broken connection wasn't replaced")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, []ConnState{StateReady, StateReady}, p.States())
+}
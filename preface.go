@@ -0,0 +1,81 @@
+package drpc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Before the first header frame, each side of a connection sends a preface
+// structure looks like:
+// +--------+---------+----------+
+// |  Magic | Version | Features |
+// +--------+---------+----------+
+// | "DRPC" |  uint8  |  uvarint |
+// +--------+---------+----------+
+// A peer that sends a different magic or version is rejected, so the header
+// format can evolve without old and new peers misreading each other.
+
+const (
+	// ProtocolVersion is the version of the wire protocol this package speaks.
+	// Version 2 replaced the error string of ResponseHeader with a status,
+	// version 3 added the Type of ResponseHeader for streams, version 4
+	// added Flags to both headers for fragmentation and flow control.
+	ProtocolVersion = 4
+
+	prefaceMagic = "DRPC"
+)
+
+// Features is a bitmap of optional protocol capabilities. Each side announces
+// the features it supports in its preface; a feature is used on a connection
+// only if both sides announce it.
+type Features uint64
+
+// supportedFeatures are the features this package announces.
+const supportedFeatures Features = 0
+
+type preface struct {
+	Version  uint8
+	Features Features
+}
+
+func localPreface() preface {
+	return preface{
+		Version:  ProtocolVersion,
+		Features: supportedFeatures,
+	}
+}
+
+func writePreface(w io.Writer, p preface) error {
+	var buf [len(prefaceMagic) + Uint8Size + binary.MaxVarintLen64]byte
+	idx := copy(buf[:], prefaceMagic)
+	buf[idx] = p.Version
+	idx += Uint8Size
+	idx += binary.PutUvarint(buf[idx:], uint64(p.Features))
+	return write(w, buf[:idx])
+}
+
+// readPreface reads the preface of the peer and checks that it speaks our
+// version of the protocol.
+func readPreface(r io.Reader) (p preface, err error) {
+	var head [len(prefaceMagic) + Uint8Size]byte
+	if _, err = io.ReadFull(r, head[:]); err != nil {
+		return
+	}
+	if string(head[:len(prefaceMagic)]) != prefaceMagic {
+		err = ErrBadPreface
+		return
+	}
+	p.Version = head[len(prefaceMagic)]
+
+	features, err := binary.ReadUvarint(r.(io.ByteReader))
+	if err != nil {
+		return
+	}
+	p.Features = Features(features)
+
+	if p.Version != ProtocolVersion {
+		err = fmt.Errorf("%w: peer speaks version %d, we speak version %d", ErrVersionMismatch, p.Version, ProtocolVersion)
+	}
+	return
+}
@@ -0,0 +1,355 @@
+package drpc
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ConnState is the connectivity state of a ReconnectingClient.
+type ConnState int
+
+const (
+	// StateConnecting means the client is dialing the server.
+	StateConnecting ConnState = iota
+	// StateReady means the client is connected.
+	StateReady
+	// StateTransientFailure means the last dial failed, or its connection
+	// broke right away, and the client waits for its backoff to pass before
+	// dialing again.
+	StateTransientFailure
+	// StateShutdown means the client was closed.
+	StateShutdown
+)
+
+var connStateNames = [...]string{"CONNECTING", "READY", "TRANSIENT_FAILURE", "SHUTDOWN"}
+
+func (s ConnState) String() string {
+	if s >= 0 && int(s) < len(connStateNames) {
+		return connStateNames[s]
+	}
+	return "ConnState(" + strconv.Itoa(int(s)) + ")"
+}
+
+// Backoff says how long to wait between failed dials. The first retry waits
+// BaseDelay, each further one Multiplier times as long, up to MaxDelay. Every
+// delay is then moved randomly by up to Jitter times itself, so that clients
+// that lost the same server don't all dial it at once.
+type Backoff struct {
+	BaseDelay  time.Duration
+	Multiplier float64
+	Jitter     float64
+	MaxDelay   time.Duration
+}
+
+// DefaultBackoff is the Backoff of a ReconnectingClient unless WithBackoff
+// says otherwise.
+var DefaultBackoff = Backoff{
+	BaseDelay:  time.Second,
+	Multiplier: 1.6,
+	Jitter:     0.2,
+	MaxDelay:   2 * time.Minute,
+}
+
+// minConnectTime is how long a connection must stay up to count as working.
+// One that breaks sooner, e.g. because the server speaks another protocol
+// version, counts as a failed dial, so the client backs off before the next.
+const minConnectTime = time.Second
+
+// delay returns how long to wait after retries failed retries in a row.
+func (b Backoff) delay(retries int) time.Duration {
+	d, max := float64(b.BaseDelay), float64(b.MaxDelay)
+	for ; d < max && retries > 0; retries-- {
+		d *= b.Multiplier
+	}
+	if d > max {
+		d = max
+	}
+	d *= 1 + b.Jitter*(2*rand.Float64()-1)
+	if d < 0 {
+		return 0
+	}
+	return time.Duration(d)
+}
+
+// ReconnectingClient is a client that outlives its connections. It dials in
+// the background, and dials again whenever the connection breaks, waiting
+// according to its Backoff after each failed dial and after each connection
+// that broke within minConnectTime.
+//
+// While there is no connection, calls wait for one as long as the client is
+// connecting. Once a dial failed they fail with ErrUnavailable, unless
+// WithWaitForReady was given. Calls that were in flight when the connection
+// broke fail with its error; they aren't retried, since the server may have
+// run them.
+type ReconnectingClient struct {
+	dial         func() (*Client, error)
+	backoff      Backoff
+	waitForReady bool
+	logger       Logger
+	closed       chan struct{} // closed by Close
+
+	mu      sync.Mutex // protects following
+	state   ConnState
+	client  *Client       // set while ready
+	changed chan struct{} // closed and replaced when state changes
+}
+
+// DialReconnecting returns a ReconnectingClient that dials address with Dial
+// and opts. It returns at once; the first dial happens in the background.
+func DialReconnecting(network, address string, opts ...DialOption) *ReconnectingClient {
+	return NewReconnectingClient(func() (*Client, error) {
+		return Dial(network, address, opts...)
+	}, opts...)
+}
+
+// NewReconnectingClient returns a ReconnectingClient that calls dial for each
+// connection, e.g. to connect with DialTLS. Of opts, it uses the backoff, the
+// logger and WithWaitForReady.
+func NewReconnectingClient(dial func() (*Client, error), opts ...DialOption) *ReconnectingClient {
+	o := defaultDialOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	r := &ReconnectingClient{
+		dial:         dial,
+		backoff:      o.backoff,
+		waitForReady: o.waitForReady,
+		logger:       o.logger,
+		closed:       make(chan struct{}),
+		state:        StateConnecting,
+		changed:      make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// run dials until the client is closed.
+func (r *ReconnectingClient) run() {
+	retries := 0
+	for r.setState(StateConnecting, nil) {
+		client, err := r.dial()
+		if err == nil {
+			if !r.setState(StateReady, client) {
+				client.Close()
+				return
+			}
+			start := time.Now()
+			select {
+			case <-client.done:
+			case <-r.closed:
+				return
+			}
+			client.Close()
+			if time.Since(start) >= minConnectTime {
+				retries = 0
+				continue
+			}
+		}
+
+		delay := r.backoff.delay(retries)
+		if err != nil {
+			r.logger.Log(LevelWarn, "rpc:dial failed, retrying", "err", err, "delay", delay)
+		} else {
+			r.logger.Log(LevelWarn, "rpc:connection broke right away, retrying", "delay", delay)
+		}
+		if !r.setState(StateTransientFailure, nil) {
+			return
+		}
+		retries++
+		select {
+		case <-time.After(delay):
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+// setState moves the client to state, with client as its connection. It
+// reports false, and changes nothing, once the client is closed.
+func (r *ReconnectingClient) setState(state ConnState, client *Client) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state == StateShutdown {
+		return false
+	}
+	r.client = client
+	if r.state != state {
+		r.state = state
+		close(r.changed)
+		r.changed = make(chan struct{})
+	}
+	return true
+}
+
+// State returns the current connectivity state.
+func (r *ReconnectingClient) State() ConnState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state
+}
+
+// WaitForStateChange waits until the state differs from source and reports
+// true, or until ctx is done and reports false.
+func (r *ReconnectingClient) WaitForStateChange(ctx context.Context, source ConnState) bool {
+	for {
+		r.mu.Lock()
+		state, changed := r.state, r.changed
+		r.mu.Unlock()
+		if state != source {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// ready returns the current connection, waiting for one as the client's
+// policy says.
+func (r *ReconnectingClient) ready(ctx context.Context) (*Client, error) {
+	for {
+		r.mu.Lock()
+		state, client, changed := r.state, r.client, r.changed
+		r.mu.Unlock()
+		switch {
+		case state == StateReady:
+			return client, nil
+		case state == StateShutdown:
+			return nil, ErrShutdown
+		case state == StateTransientFailure && !r.waitForReady:
+			return nil, ErrUnavailable
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// retry tells whether err, returned by client, means the request never left
+// and should go out on the next connection. It waits until client is gone
+// and r no longer hands it out.
+func (r *ReconnectingClient) retry(client *Client, err error) bool {
+	if err != ErrShutdown {
+		return false
+	}
+	select {
+	case <-client.done:
+	case <-r.closed:
+		return false
+	}
+	for {
+		r.mu.Lock()
+		current, changed := r.client, r.changed
+		r.mu.Unlock()
+		if current != client {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-r.closed:
+			return false
+		}
+	}
+}
+
+func (r *ReconnectingClient) Call(serviceMethod string, args, reply Serializer) error {
+	return r.CallContext(context.Background(), serviceMethod, args, reply)
+}
+
+// CallContext is like Client.CallContext, over the current connection.
+func (r *ReconnectingClient) CallContext(ctx context.Context, serviceMethod string, args, reply Serializer) error {
+	call := <-r.GoContext(ctx, serviceMethod, args, reply).Done
+	return call.Error
+}
+
+func (r *ReconnectingClient) Go(serviceMethod string, args, reply Serializer) *Call {
+	return r.GoContext(context.Background(), serviceMethod, args, reply)
+}
+
+// GoContext is like Client.GoContext, over the current connection.
+func (r *ReconnectingClient) GoContext(ctx context.Context, serviceMethod string, args, reply Serializer) *Call {
+	call := NewCall(serviceMethod, args, reply)
+	call.ctx = ctx
+	go func() {
+		r.invoke(call)
+		call.done()
+	}()
+	return call
+}
+
+// invoke makes call over the current connection and waits for it to
+// complete, filling in its Error and Metadata. It doesn't call call.done.
+func (r *ReconnectingClient) invoke(call *Call) {
+	for {
+		client, err := r.ready(call.ctx)
+		if err != nil {
+			call.Error = err
+			return
+		}
+		done := <-client.GoContext(call.ctx, call.ServiceMethod, call.Args, call.Reply).Done
+		if r.retry(client, done.Error) {
+			continue
+		}
+		call.Error = done.Error
+		call.Metadata = done.Metadata
+		return
+	}
+}
+
+// CallStream is like Client.CallStream, over the current connection.
+func (r *ReconnectingClient) CallStream(ctx context.Context, serviceMethod string, args Serializer) (*ClientStream, error) {
+	for {
+		client, err := r.ready(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s, err := client.CallStream(ctx, serviceMethod, args)
+		if !r.retry(client, err) {
+			return s, err
+		}
+	}
+}
+
+// NewStream is like Client.NewStream, over the current connection. The
+// stream breaks with the connection it was opened on.
+func (r *ReconnectingClient) NewStream(ctx context.Context, serviceMethod string) (*ClientStream, error) {
+	for {
+		client, err := r.ready(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s, err := client.NewStream(ctx, serviceMethod)
+		if !r.retry(client, err) {
+			return s, err
+		}
+	}
+}
+
+// Close stops reconnecting and closes the current connection. Calls waiting
+// for a connection fail with ErrShutdown.
+func (r *ReconnectingClient) Close() error {
+	r.mu.Lock()
+	if r.state == StateShutdown {
+		r.mu.Unlock()
+		return ErrShutdown
+	}
+	client := r.client
+	r.client = nil
+	r.state = StateShutdown
+	close(r.changed)
+	r.changed = make(chan struct{})
+	close(r.closed)
+	r.mu.Unlock()
+
+	if client != nil {
+		return client.Close()
+	}
+	return nil
+}
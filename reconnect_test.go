@@ -0,0 +1,202 @@
+package drpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testBackoff = Backoff{
+	BaseDelay:  10 * time.Millisecond,
+	Multiplier: 2,
+	MaxDelay:   50 * time.Millisecond,
+}
+
+// listenSleep serves a new sleep server on addr, retrying for a while in
+// case the port is still held by the previous listener.
+func listenSleep(t *testing.T, addr string) *Server {
+	for deadline := time.Now().Add(time.Second); ; {
+		listener, err := net.Listen("tcp", addr)
+		if err == nil {
+			server := NewServer()
+			serveSleepOn(server, listener)
+			t.Cleanup(func() { server.Close() })
+			return server
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// freeAddr returns an address nobody listens on.
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func waitForState(t *testing.T, r *ReconnectingClient, want ConnState) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for state := r.State(); state != want; state = r.State() {
+		if !r.WaitForStateChange(ctx, state) {
+			t.Fatalf("state is %v, want %v", state, want)
+		}
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{BaseDelay: 10 * time.Millisecond, Multiplier: 2, MaxDelay: 50 * time.Millisecond}
+	var delays []time.Duration
+	for i := 0; i < 5; i++ {
+		delays = append(delays, b.delay(i))
+	}
+	assert.Equal(t, []time.Duration{10e6, 20e6, 40e6, 50e6, 50e6}, delays)
+
+	b.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := b.delay(10)
+		assert.GreaterOrEqual(t, d, 25*time.Millisecond)
+		assert.LessOrEqual(t, d, 75*time.Millisecond)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	addr := freeAddr(t)
+	server := listenSleep(t, addr)
+	client := DialReconnecting("tcp", addr, WithBackoff(testBackoff), WithWaitForReady(true))
+	defer client.Close()
+
+	reply := new(mathReply)
+	assert.NoError(t, client.Call("Sleep.Sleep", &mathArgs{A: 1}, reply))
+	assert.Equal(t, StateReady, client.State())
+
+	server.Close()
+	waitForState(t, client, StateTransientFailure)
+
+	// The call waits for the server to come back.
+	call := client.Go("Sleep.Sleep", &mathArgs{A: 2}, reply)
+	listenSleep(t, addr)
+	<-call.Done
+	assert.NoError(t, call.Error)
+	assert.Equal(t, 2, reply.C)
+	assert.Equal(t, StateReady, client.State())
+}
+
+func TestReconnectFailFast(t *testing.T) {
+	addr := freeAddr(t)
+	client := DialReconnecting("tcp", addr, WithBackoff(testBackoff))
+	defer client.Close()
+
+	waitForState(t, client, StateTransientFailure)
+	err := client.Call("Sleep.Sleep", &mathArgs{A: 1}, new(mathReply))
+	assert.Equal(t, ErrUnavailable, err)
+	_, err = client.NewStream(context.Background(), "Sleep.Stream")
+	assert.Equal(t, ErrUnavailable, err)
+
+	listenSleep(t, addr)
+	waitForState(t, client, StateReady)
+	assert.NoError(t, client.Call("Sleep.Sleep", &mathArgs{A: 1}, new(mathReply)))
+}
+
+func TestReconnectStates(t *testing.T) {
+	addr := freeAddr(t)
+	server := listenSleep(t, addr)
+	client := DialReconnecting("tcp", addr, WithBackoff(testBackoff))
+	waitForState(t, client, StateReady)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.False(t, client.WaitForStateChange(ctx, StateReady))
+
+	server.Close()
+	assert.True(t, client.WaitForStateChange(context.Background(), StateReady))
+	waitForState(t, client, StateTransientFailure)
+	listenSleep(t, addr)
+	waitForState(t, client, StateReady)
+
+	assert.NoError(t, client.Close())
+	assert.Equal(t, StateShutdown, client.State())
+	assert.True(t, client.WaitForStateChange(context.Background(), StateReady))
+	assert.Equal(t, ErrShutdown, client.Close())
+	assert.Equal(t, ErrShutdown, client.Call("Sleep.Sleep", &mathArgs{A: 1}, new(mathReply)))
+}
+
+func TestReconnectBacksOffFromBrokenServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// The server sends garbage instead of a preface and counts the
+	// connections the client closes.
+	closed := make(chan struct{}, 100)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("garbage garbage garbage"))
+				io.Copy(io.Discard, conn)
+				closed <- struct{}{}
+			}()
+		}
+	}()
+
+	var dials int32
+	client := NewReconnectingClient(func() (*Client, error) {
+		atomic.AddInt32(&dials, 1)
+		return Dial("tcp", listener.Addr().String())
+	}, WithBackoff(testBackoff))
+	waitForState(t, client, StateTransientFailure)
+	time.Sleep(200 * time.Millisecond)
+	client.Close()
+
+	n := int(atomic.LoadInt32(&dials))
+	assert.Less(t, n, 10)
+	for i := 0; i < n; i++ {
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatalf("%d of %d connections left open", n-i, n)
+		}
+	}
+}
+
+func TestRetryWaitsForNextConnection(t *testing.T) {
+	conn, peer := net.Pipe()
+	peer.Close()
+	dead := NewClient(conn)
+	<-dead.done
+
+	r := &ReconnectingClient{
+		closed:  make(chan struct{}),
+		state:   StateReady,
+		client:  dead,
+		changed: make(chan struct{}),
+	}
+	retried := make(chan bool, 1)
+	go func() { retried <- r.retry(dead, ErrShutdown) }()
+
+	// The client is still handed out until the state moves on.
+	select {
+	case <-retried:
+		t.Fatal("retry returned while the dead client was still current")
+	case <-time.After(20 * time.Millisecond):
+	}
+	r.setState(StateConnecting, nil)
+	assert.True(t, <-retried)
+}
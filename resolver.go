@@ -0,0 +1,220 @@
+package drpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resolver finds the servers of a service and follows them as they come and
+// go.
+type Resolver interface {
+	// Watch calls update with the addresses of the servers of service, once
+	// before it returns and then whenever they change, until ctx is done.
+	// Each call passes the complete set, and calls don't overlap. Watch
+	// fails if it can't find the servers the first time.
+	Watch(ctx context.Context, service string, update func([]Address)) error
+}
+
+// DefaultResolveInterval is how often DNSResolver and FileResolver look for
+// changes unless told otherwise.
+const DefaultResolveInterval = 30 * time.Second
+
+// DialTarget returns a Balancer over the servers resolver finds for target,
+// a name like "drpc:///math" whose path is the service. The backends follow
+// the changes resolver reports until the Balancer is closed.
+func DialTarget(network, target string, resolver Resolver, opts ...DialOption) (*Balancer, error) {
+	service, err := parseTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b := DialBalancer(network, nil, opts...)
+	b.stopResolver = cancel
+	if err := resolver.Watch(ctx, service, b.UpdateAddresses); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// parseTarget returns the service of target.
+func parseTarget(target string) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	service := strings.TrimPrefix(u.Path, "/")
+	if u.Scheme != "drpc" || service == "" {
+		return "", fmt.Errorf("rpc: target %q is not like drpc:///service", target)
+	}
+	return service, nil
+}
+
+// StaticResolver is a Resolver over a fixed set of addresses per service.
+type StaticResolver map[string][]Address
+
+func (r StaticResolver) Watch(ctx context.Context, service string, update func([]Address)) error {
+	addrs, ok := r[service]
+	if !ok {
+		return fmt.Errorf("rpc: unknown service %q", service)
+	}
+	update(addrs)
+	return nil
+}
+
+// DNSResolver is a Resolver that looks up the SRV records of
+// _service._tcp.Domain. Of the records, those with the lowest priority are
+// used, and their weights become the weights of the addresses.
+type DNSResolver struct {
+	Domain string
+	// Resolver does the lookups; nil means net.DefaultResolver.
+	Resolver *net.Resolver
+	// Interval is how often the records are looked up again; zero means
+	// DefaultResolveInterval.
+	Interval time.Duration
+}
+
+func (r *DNSResolver) Watch(ctx context.Context, service string, update func([]Address)) error {
+	addrs, err := r.lookup(ctx, service)
+	if err != nil {
+		return err
+	}
+	update(addrs)
+	go poll(ctx, r.Interval, addrs, func() ([]Address, error) {
+		return r.lookup(ctx, service)
+	}, update)
+	return nil
+}
+
+func (r *DNSResolver) lookup(ctx context.Context, service string) ([]Address, error) {
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	_, records, err := resolver.LookupSRV(ctx, service, "tcp", r.Domain)
+	if err != nil {
+		return nil, err
+	}
+	// The records come sorted by priority.
+	var addrs []Address
+	for _, srv := range records {
+		if srv.Priority != records[0].Priority {
+			break
+		}
+		addrs = append(addrs, Address{
+			Addr:   net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))),
+			Weight: int(srv.Weight),
+		})
+	}
+	return addrs, nil
+}
+
+// FileResolver is a Resolver that reads the addresses from a JSON file that
+// maps each service to its servers, like
+//
+//	{"math": [{"addr": "10.0.0.1:8888", "weight": 2}, {"addr": "10.0.0.2:8888"}]}
+//
+// It looks at the file every Interval and reports the changes. While the file
+// can't be read or parsed, the servers stay as they were.
+type FileResolver struct {
+	Path string
+	// Interval is how often the file is read again; zero means
+	// DefaultResolveInterval.
+	Interval time.Duration
+}
+
+func (r *FileResolver) Watch(ctx context.Context, service string, update func([]Address)) error {
+	read := r.reader(service)
+	addrs, err := read()
+	if err != nil {
+		return err
+	}
+	update(addrs)
+	go poll(ctx, r.Interval, addrs, read, update)
+	return nil
+}
+
+// reader returns a function that reads the addresses of service, skipping
+// the parsing if the file didn't change.
+func (r *FileResolver) reader(service string) func() ([]Address, error) {
+	var last []byte
+	var addrs []Address
+	return func() ([]Address, error) {
+		data, err := os.ReadFile(r.Path)
+		if err != nil {
+			return nil, err
+		}
+		if last != nil && bytes.Equal(data, last) {
+			return addrs, nil
+		}
+		var services map[string][]struct {
+			Addr   string `json:"addr"`
+			Weight int    `json:"weight"`
+		}
+		if err := json.Unmarshal(data, &services); err != nil {
+			return nil, fmt.Errorf("rpc: bad resolver file %s: %w", r.Path, err)
+		}
+		servers, ok := services[service]
+		if !ok {
+			return nil, fmt.Errorf("rpc: unknown service %q in %s", service, r.Path)
+		}
+		addrs = make([]Address, len(servers))
+		for i, s := range servers {
+			addrs[i] = Address{Addr: s.Addr, Weight: s.Weight}
+		}
+		last = data
+		return addrs, nil
+	}
+}
+
+// poll calls lookup every interval until ctx is done, and update whenever the
+// addresses differ from the last ones. Failed lookups are skipped.
+func poll(ctx context.Context, interval time.Duration, last []Address, lookup func() ([]Address, error), update func([]Address)) {
+	if interval <= 0 {
+		interval = DefaultResolveInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		addrs, err := lookup()
+		if err != nil || sameAddressSet(addrs, last) {
+			continue
+		}
+		update(addrs)
+		last = addrs
+	}
+}
+
+// sameAddressSet reports whether a and b hold the same addresses, in any
+// order.
+func sameAddressSet(a, b []Address) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	sorted := func(addrs []Address) []Address {
+		addrs = append([]Address(nil), addrs...)
+		sort.Slice(addrs, func(i, j int) bool { return addrs[i].Addr < addrs[j].Addr })
+		return addrs
+	}
+	a, b = sorted(a), sorted(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,188 @@
+package drpc
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTarget(t *testing.T) {
+	service, err := parseTarget("drpc:///math")
+	assert.NoError(t, err)
+	assert.Equal(t, "math", service)
+
+	for _, target := range []string{"drpc:///", "http:///math", ":8888", "math"} {
+		_, err := parseTarget(target)
+		assert.Error(t, err, target)
+	}
+}
+
+func TestDialTargetStatic(t *testing.T) {
+	a, _ := startNamedServer(t, "a")
+	resolver := StaticResolver{"math": {{Addr: a}}}
+	balancer, err := DialTarget("tcp", "drpc:///math", resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer balancer.Close()
+	assert.Equal(t, "a", getName(t, balancer))
+
+	_, err = DialTarget("tcp", "drpc:///echo", resolver)
+	assert.Error(t, err)
+}
+
+func TestFileResolver(t *testing.T) {
+	a, _ := startNamedServer(t, "a")
+	b, _ := startNamedServer(t, "b")
+	path := filepath.Join(t.TempDir(), "servers.json")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"math": [{"addr": "` + a + `"}]}`)
+
+	resolver := &FileResolver{Path: path, Interval: 10 * time.Millisecond}
+	balancer, err := DialTarget("tcp", "drpc:///math", resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer balancer.Close()
+	assert.Equal(t, "a", getName(t, balancer))
+
+	write(`{"math": [{"addr": "` + b + `", "weight": 2}]}`)
+	waitForBalancer(t, balancer, StateReady, b)
+	assert.Equal(t, "b", getName(t, balancer))
+
+	// A broken file leaves the servers as they were.
+	write(`{"math": [`)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "b", getName(t, balancer))
+	assert.Equal(t, map[string]ConnState{b: StateReady}, balancer.States())
+
+	_, err = DialTarget("tcp", "drpc:///math", &FileResolver{Path: path})
+	assert.Error(t, err)
+}
+
+// startDNSStub starts a DNS server on a local UDP port that answers every
+// question with the SRV records returns, and a resolver that asks it.
+func startDNSStub(t *testing.T, records func() []net.SRV) *net.Resolver {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := srvResponse(buf[:n], records()); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", conn.LocalAddr().String())
+		},
+	}
+}
+
+// srvResponse answers the DNS query with records.
+func srvResponse(query []byte, records []net.SRV) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	// Find the end of the question: the name, then type and class.
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5
+	if end > len(query) {
+		return nil
+	}
+
+	resp := append([]byte(nil), query[:2]...) // ID
+	resp = binary.BigEndian.AppendUint16(resp, 0x8580)
+	resp = binary.BigEndian.AppendUint16(resp, 1)
+	resp = binary.BigEndian.AppendUint16(resp, uint16(len(records)))
+	resp = append(resp, 0, 0, 0, 0)
+	resp = append(resp, query[12:end]...)
+	for _, srv := range records {
+		var target []byte
+		for _, label := range strings.Split(strings.TrimSuffix(srv.Target, "."), ".") {
+			target = append(target, byte(len(label)))
+			target = append(target, label...)
+		}
+		target = append(target, 0)
+
+		resp = append(resp, 0xc0, 12) // the name of the question
+		resp = binary.BigEndian.AppendUint16(resp, 33)
+		resp = binary.BigEndian.AppendUint16(resp, 1)
+		resp = binary.BigEndian.AppendUint32(resp, 60)
+		resp = binary.BigEndian.AppendUint16(resp, uint16(6+len(target)))
+		resp = binary.BigEndian.AppendUint16(resp, srv.Priority)
+		resp = binary.BigEndian.AppendUint16(resp, srv.Weight)
+		resp = binary.BigEndian.AppendUint16(resp, srv.Port)
+		resp = append(resp, target...)
+	}
+	return resp
+}
+
+func TestDNSResolver(t *testing.T) {
+	var mu sync.Mutex
+	records := []net.SRV{
+		{Target: "s1.example.com.", Port: 8001, Priority: 1, Weight: 5},
+		{Target: "s2.example.com.", Port: 8002, Priority: 1, Weight: 1},
+		{Target: "s3.example.com.", Port: 8003, Priority: 2, Weight: 1}, // backup
+	}
+	resolver := &DNSResolver{
+		Domain:   "example.com",
+		Interval: 10 * time.Millisecond,
+		Resolver: startDNSStub(t, func() []net.SRV {
+			mu.Lock()
+			defer mu.Unlock()
+			return records
+		}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan []Address, 10)
+	if err := resolver.Watch(ctx, "math", func(addrs []Address) { updates <- addrs }); err != nil {
+		t.Fatal(err)
+	}
+	assert.ElementsMatch(t, []Address{
+		{Addr: "s1.example.com:8001", Weight: 5},
+		{Addr: "s2.example.com:8002", Weight: 1},
+	}, <-updates)
+
+	mu.Lock()
+	records = records[1:]
+	mu.Unlock()
+	select {
+	case addrs := <-updates:
+		assert.Equal(t, []Address{{Addr: "s2.example.com:8002", Weight: 1}}, addrs)
+	case <-time.After(2 * time.Second):
+		t.Fatal("no update after the records changed")
+	}
+	select {
+	case addrs := <-updates:
+		t.Fatalf("update %v without a change", addrs)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
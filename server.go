@@ -2,81 +2,335 @@ package drpc
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
-	"log"
 	"net"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"time"
 )
 
 var _ ServerCodec = (*serverCodec)(nil)
 
 type Handler func(args []byte) ([]byte, error)
 
+// ContextHandler is a Handler that also receives the context of the request.
+// The context is cancelled when the client's deadline passes, when the client
+// cancels the call, or when the connection drops.
+type ContextHandler func(ctx context.Context, args []byte) ([]byte, error)
+
+// method is a registered method. Exactly one of unary and stream is set.
+type method struct {
+	unary  ContextHandler
+	stream func(stream *serverStream) error
+}
+
 type service struct {
-	methodMap map[string]Handler
+	methodMap map[string]*method
 }
 
 func NewService() *service {
 	return &service{
-		methodMap: make(map[string]Handler),
+		methodMap: make(map[string]*method),
 	}
 }
 
+// DefaultMaxConcurrentRequests is the number of handlers a Server runs at
+// once for a single connection unless WithMaxConcurrentRequests says otherwise.
+const DefaultMaxConcurrentRequests = 100
+
+const (
+	// shutdownPollInterval is how often Shutdown checks for idle connections.
+	shutdownPollInterval = 10 * time.Millisecond
+
+	// Serve sleeps between minAcceptDelay and maxAcceptDelay after a
+	// temporary Accept error, doubling the delay each time.
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
 type Server struct {
 	serviceMap sync.Map
+	opts       serverOptions
+
+	mu         sync.Mutex // protects following
+	inShutdown bool
+	listeners  map[net.Listener]struct{}
+	conns      map[*serverConn]struct{}
+	handshakes map[net.Conn]struct{} // conns still in ServeConn's handshake
 }
 
-func NewServer() *Server {
-	return &Server{}
+func NewServer(opts ...ServerOption) *Server {
+	s := &Server{
+		opts:       defaultServerOptions(),
+		listeners:  make(map[net.Listener]struct{}),
+		conns:      make(map[*serverConn]struct{}),
+		handshakes: make(map[net.Conn]struct{}),
+	}
+	for _, opt := range opts {
+		opt(&s.opts)
+	}
+	return s
 }
 
-func (s *Server) Serve(listener net.Listener) {
+// PanicHook is told about every panic the server recovered from in a handler
+// or interceptor, e.g. to count them.
+type PanicHook func(method string, recovered interface{})
+
+// Serve accepts connections on listener and serves each in its own
+// goroutine. It backs off and retries on temporary Accept errors such as
+// running out of file descriptors. Serve always returns a non-nil error:
+// ErrServerClosed after Shutdown or Close, otherwise the error that stopped
+// Accept.
+func (s *Server) Serve(listener net.Listener) error {
+	if !s.trackListener(listener, true) {
+		listener.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(listener, false)
+	if s.opts.tlsConfig != nil {
+		listener = tls.NewListener(listener, s.opts.tlsConfig)
+	}
+
+	var tempDelay time.Duration // how long to sleep on accept failure
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Println(err)
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if isTemporary(err) {
+				if tempDelay == 0 {
+					tempDelay = minAcceptDelay
+				} else {
+					tempDelay *= 2
+				}
+				if tempDelay > maxAcceptDelay {
+					tempDelay = maxAcceptDelay
+				}
+				s.opts.logger.Log(LevelWarn, "rpc:accept failed, retrying", "err", err, "delay", tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
 		}
+		tempDelay = 0
 		go s.ServeConn(conn)
 	}
 }
 
+func isTemporary(err error) bool {
+	var te interface{ Temporary() bool }
+	return errors.As(err, &te) && te.Temporary()
+}
+
+// ServeConn serves conn until the client hangs up. If conn is a *tls.Conn,
+// the handshake is finished first and handlers can read the result with
+// PeerFromContext.
 func (s *Server) ServeConn(conn net.Conn) {
-	codec := NewServerCodec(conn)
-	s.ServeCodec(codec)
+	if !s.trackHandshake(conn, true) {
+		conn.Close()
+		return
+	}
+	peer, err := handshake(conn)
+	s.trackHandshake(conn, false)
+	if err != nil {
+		s.opts.logger.Log(LevelWarn, "rpc:tls handshake failed", "remote", conn.RemoteAddr(), "err", err)
+		conn.Close()
+		return
+	}
+	nc := &notifyConn{Conn: conn}
+	var codec ServerCodec
+	if s.opts.codec != nil {
+		codec = s.opts.codec(nc)
+	} else {
+		codec = newServerCodec(nc, s.opts.limits)
+	}
+	s.serveCodec(codec, peer, nc)
 }
 
 func (s *Server) ServeCodec(codec ServerCodec) {
-	defer codec.Close()
+	s.serveCodec(codec, nil, nil)
+}
+
+// serveCodec serves codec. nc, if not nil, is the conn codec reads from.
+func (s *Server) serveCodec(codec ServerCodec, peer *Peer, nc *notifyConn) {
+	c := newServerConn(s, codec, peer)
+	if !s.trackConn(c, true) {
+		codec.Close()
+		return
+	}
+	defer s.trackConn(c, false)
+	if nc != nil {
+		nc.onRead = func() { c.setIdle(false) }
+	}
+
+	c.serve()
+}
+
+// Shutdown gracefully shuts down the server. It closes all listeners, so that
+// Serve returns ErrServerClosed, makes every connection answer new requests
+// with ErrServerDraining, waits for the requests already in flight to be
+// answered, and then closes the connections.
+// If ctx is done first, Shutdown returns ctx.Err() and leaves the remaining
+// connections open; call Close to tear them down.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.inShutdown = true
+	err := s.closeListenersLocked()
+	for c := range s.conns {
+		c.startDraining()
+	}
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
 	for {
-		req, handler, args, err := s.readRequest(codec)
-		if err != nil {
-			if err != io.EOF {
-				log.Println("rpc:failed to read request, err:", err)
-			}
-			break
+		if s.closeIdleConns() {
+			return err
 		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
 
-		if err := s.call(req, codec, handler, args); err != nil {
-			log.Println("rpc:failed to send response, err:", err)
-			break
+// Close immediately closes all listeners and connections. Handlers still
+// running see their context cancelled and their responses are discarded.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inShutdown = true
+	err := s.closeListenersLocked()
+	for c := range s.conns {
+		c.close()
+	}
+	for conn := range s.handshakes {
+		conn.Close()
+	}
+	return err
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inShutdown
+}
+
+func (s *Server) closeListenersLocked() error {
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
 		}
+		delete(s.listeners, l)
 	}
+	return err
 }
 
-func (s *Server) readRequest(codec ServerCodec) (req *RequestHeader, handler Handler, args []byte, err error) {
+// closeIdleConns closes the connections with no request in flight and reports
+// whether all connections are closed. Connections still in the handshake
+// have none, so they are closed too.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	quiescent := len(s.handshakes) == 0
+	for conn := range s.handshakes {
+		conn.Close()
+	}
+	for c := range s.conns {
+		if !c.closeIfIdle() {
+			quiescent = false
+		}
+	}
+	return quiescent
+}
+
+// trackListener adds or removes l from the listeners Shutdown closes. It
+// reports false if the server is already shutting down.
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.inShutdown {
+			return false
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
+
+// trackHandshake adds or removes conn from the connections Shutdown and Close
+// close while ServeConn handshakes. It reports false if the server is already
+// shutting down.
+func (s *Server) trackHandshake(conn net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.inShutdown {
+			return false
+		}
+		s.handshakes[conn] = struct{}{}
+	} else {
+		delete(s.handshakes, conn)
+	}
+	return true
+}
+
+// trackConn adds or removes c from the connections Shutdown drains. It reports
+// false if the server is already shutting down.
+func (s *Server) trackConn(c *serverConn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.inShutdown {
+			return false
+		}
+		s.conns[c] = struct{}{}
+	} else {
+		delete(s.conns, c)
+	}
+	return true
+}
+
+// readRequest reads the header and body of the next request. The body is
+// always read, even for requests that will be rejected, so the stream stays
+// in sync. An error means the connection can't be used any more.
+func (s *Server) readRequest(codec ServerCodec) (req *RequestHeader, args []byte, err error) {
 	req = new(RequestHeader)
-	err = codec.ReadRequestHeader(req)
-	if err != nil {
+	if err = codec.ReadRequestHeader(req); err != nil {
 		return
 	}
+	if req.Type > RequestWindowUpdate {
+		err = fmt.Errorf("rpc: unknown request type %d", req.Type)
+		return
+	}
+	if args, err = codec.ReadRequestBody(); err != nil {
+		return
+	}
+	if req.Type == RequestWindowUpdate {
+		_, err = decodeWindowUpdate(args)
+	}
+	return
+}
 
+// lookup finds the method req calls. The error, if any, is the answer to that
+// request only.
+func (s *Server) lookup(req *RequestHeader) (*method, error) {
 	dot := strings.LastIndex(req.Method, ".")
 	if dot < 0 {
-		err = fmt.Errorf("rpc: service/method request ill-formed: %s", req.Method)
-		return
+		return nil, Errorf(NotFound, "service/method request ill-formed: %s", req.Method)
 	}
 	serviceName := req.Method[:dot]
 	methodName := req.Method[dot+1:]
@@ -84,43 +338,650 @@ func (s *Server) readRequest(codec ServerCodec) (req *RequestHeader, handler Han
 	// look for the method
 	svci, ok := s.serviceMap.Load(serviceName)
 	if !ok {
-		err = fmt.Errorf("can't find service:%s", serviceName)
-		return
+		return nil, Errorf(NotFound, "can't find service:%s", serviceName)
 	}
 	svc := svci.(*service)
-	handler, ok = svc.methodMap[methodName]
+	m, ok := svc.methodMap[methodName]
 	if !ok {
-		err = fmt.Errorf("can't find method:%s", methodName)
+		return nil, Errorf(NotFound, "can't find method:%s", methodName)
+	}
+	if req.Type == RequestStream && m.stream == nil {
+		return nil, Errorf(Unimplemented, "%s is not a streaming method", req.Method)
+	}
+	if req.Type == RequestCall && m.unary == nil {
+		return nil, Errorf(Unimplemented, "%s is a streaming method", req.Method)
+	}
+	return m, nil
+}
+
+// serverConn holds the state of one connection served by ServeCodec.
+type serverConn struct {
+	server *Server
+	codec  ServerCodec
+
+	// ctx is cancelled when the connection is closed or stops being read.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	sending sync.Mutex // serializes WriteResponse
+	wg      sync.WaitGroup
+	window  *sendWindow
+	credit  *recvWindow
+	partial map[uint64]*partialRequest // used by serve only
+	// assembling counts the partial requests that keep their body; used by
+	// serve only.
+	assembling int
+
+	mu       sync.Mutex // protects following
+	inflight map[uint64]context.CancelFunc
+	streams  map[uint64]*serverStream
+	running  int               // handlers running
+	queue    []*waitingRequest // requests waiting for a handler slot
+	draining bool              // reject new requests
+	closed   bool              // codec closed by the server
+	idle     bool              // serve waits for a request, with none partly read
+}
+
+func newServerConn(s *Server, codec ServerCodec, peer *Peer) *serverConn {
+	ctx := context.Background()
+	if peer != nil {
+		ctx = context.WithValue(ctx, peerKey{}, peer)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &serverConn{
+		server:   s,
+		codec:    codec,
+		ctx:      ctx,
+		cancel:   cancel,
+		window:   newSendWindow(),
+		credit:   newRecvWindow(),
+		partial:  make(map[uint64]*partialRequest),
+		inflight: make(map[uint64]context.CancelFunc),
+		streams:  make(map[uint64]*serverStream),
+	}
+}
+
+// serve reads requests and dispatches each to its own goroutine, so a slow
+// handler doesn't hold up the others on the same connection. Responses are
+// written as handlers finish, possibly out of order; the client matches them
+// up by ID. At most maxConcurrent handlers run at once; see admit for the
+// requests that arrive while they do.
+func (c *serverConn) serve() {
+	defer c.codec.Close()
+	for {
+		c.setIdle(len(c.partial) == 0 && !buffered(c.codec))
+		req, args, err := c.server.readRequest(c.codec)
+		c.setIdle(false)
+		if err != nil {
+			if err != io.EOF && !c.isClosed() {
+				c.server.opts.logger.Log(LevelWarn, "rpc:failed to read request", "err", err)
+			}
+			break
+		}
+
+		switch req.Type {
+		case RequestCancel:
+			if c.partial[req.ID] != nil {
+				c.dropPartial(req.ID)
+				c.credit.forget(req.ID)
+			}
+			c.cancelRequest(req.ID)
+			continue
+		case RequestWindowUpdate:
+			n, _ := decodeWindowUpdate(args)
+			c.window.update(req.ID, n)
+			continue
+		case RequestCall, RequestStream:
+			// The first frame of a request counts against its own window.
+			c.credit.open(req.ID)
+		}
+		updates, err := c.credit.received(req.ID, len(args))
+		if err != nil {
+			c.server.opts.logger.Log(LevelWarn, "rpc:closing connection", "err", err)
+			c.close()
+			break
+		}
+		c.returnCredit(updates)
+		var size int
+		req, args, size, err = c.assemble(req, args)
+		if req == nil {
+			continue
+		}
+		if req.Type == RequestMessage || req.Type == RequestCloseSend {
+			c.deliver(req, args, size, err)
+			continue
+		}
+
+		// A bad request only fails itself; the connection stays up for the
+		// other calls multiplexed on it.
+		var m *method
+		if err == nil {
+			m, err = c.server.lookup(req)
+		}
+		if err != nil {
+			c.credit.forget(req.ID)
+			c.reject(req, err)
+			continue
+		}
+
+		ctx, cancel, err := c.startRequest(req)
+		if err != nil {
+			c.credit.forget(req.ID)
+			c.reject(req, err)
+			continue
+		}
+		r := &waitingRequest{id: req.ID, cancel: cancel, held: len(args)}
+		if req.Type == RequestStream {
+			stream := c.startStream(ctx, req.ID)
+			r.run = func() { c.runStream(req.Method, stream, m.stream) }
+		} else {
+			r.run = func() { c.call(ctx, req, m.unary, args, size) }
+		}
+		if err := c.admit(r); err != nil {
+			c.finishRequest(req.ID, cancel)
+			c.reject(req, err)
+		}
+	}
+	c.cancel()
+	c.window.close(ErrShutdown)
+	c.wg.Wait()
+}
+
+// partialRequest is a request whose body is still arriving in fragments.
+type partialRequest struct {
+	header *RequestHeader
+	body   []byte
+	held   int   // credit of the fragments so far that wasn't returned yet
+	err    error // set if the request is rejected; the body is dropped
+
+	counted bool // counted in serverConn.assembling
+}
+
+// maxPartialRequests is how many requests and stream messages of a
+// connection may arrive in fragments at once. Each keeps up to MaxBodySize
+// until its last fragment arrives; the ones beyond fail with
+// errTooManyPartial.
+const maxPartialRequests = 64
+
+var errTooManyPartial = NewError(ResourceExhausted, "too many requests arriving in fragments")
+
+// assemble collects the fragments of request bodies. It returns the header
+// of the first fragment with the whole body once the last fragment arrived,
+// and a nil header before then, along with the credit to return once the
+// body is consumed. The error is set if a fragment failed its checksum, the
+// body exceeds MaxBodySize, or too many requests arrive in fragments; it is
+// the answer to that request only. A request that isn't a continuation replaces any unfinished one with
+// the same ID.
+func (c *serverConn) assemble(req *RequestHeader, body []byte) (*RequestHeader, []byte, int, error) {
+	p := c.partial[req.ID]
+	if req.Type != RequestContinuation {
+		p = &partialRequest{header: req}
+		if req.Flags&FlagMore != 0 && c.assembling >= maxPartialRequests {
+			// Keep only what the answer needs.
+			p.header = &RequestHeader{Type: req.Type, ID: req.ID}
+			p.err = errTooManyPartial
+		}
+	} else if p == nil {
+		// The rest of a request that was cancelled.
+		return nil, nil, 0, nil
+	}
+	switch size := len(p.body) + len(body); {
+	case p.err != nil:
+	case req.Checksum != crc32.ChecksumIEEE(body):
+		p.err = NewError(DataLoss, "request checksum mismatch")
+	case size > c.server.opts.limits.MaxBodySize:
+		p.err = errTooLarge("request", uint64(size), c.server.opts.limits.MaxBodySize)
+	default:
+		p.body = append(p.body, body...)
+	}
+	if p.err != nil {
+		p.body = nil
+	}
+
+	if req.Flags&FlagMore != 0 {
+		c.keepPartial(req.ID, p)
+		// The body must arrive whole before it can be consumed. Up to half a
+		// window of it is held until then, so that unread messages push
+		// back on the client; the rest is consumed right away, so that
+		// bodies larger than the window can arrive.
+		p.held += len(body)
+		if n := p.held - StreamWindowSize/2; n > 0 {
+			p.held -= n
+			c.consumed(req.ID, n)
+		}
+		return nil, nil, 0, nil
+	}
+	c.dropPartial(req.ID)
+	return p.header, p.body, p.held + len(body), p.err
+}
+
+// keepPartial stores p as the unfinished request with the given id.
+func (c *serverConn) keepPartial(id uint64, p *partialRequest) {
+	if c.partial[id] != p {
+		c.dropPartial(id)
+	}
+	if counted := p.err == nil; counted != p.counted {
+		p.counted = counted
+		if counted {
+			c.assembling++
+		} else {
+			c.assembling--
+		}
+	}
+	c.partial[id] = p
+}
+
+// dropPartial forgets the unfinished request with the given id, if any.
+func (c *serverConn) dropPartial(id uint64) {
+	if p := c.partial[id]; p != nil {
+		if p.counted {
+			c.assembling--
+		}
+		delete(c.partial, id)
+	}
+}
+
+// startRequest derives the context of req from the connection context and
+// registers it so a later cancel frame can find it. The context carries the
+// request metadata and collects the response metadata. It fails with
+// ErrServerDraining once the server is shutting down.
+func (c *serverConn) startRequest(req *RequestHeader) (context.Context, context.CancelFunc, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.draining {
+		return nil, nil, ErrServerDraining
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if req.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(c.ctx, req.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(c.ctx)
+	}
+	ctx = context.WithValue(ctx, incomingMetadataKey{}, req.Metadata)
+	ctx = context.WithValue(ctx, responseMetadataKey{}, new(responseMetadata))
+	c.inflight[req.ID] = cancel
+	c.window.open(req.ID)
+	c.credit.open(req.ID)
+	return ctx, cancel, nil
+}
+
+func (c *serverConn) cancelRequest(id uint64) {
+	c.mu.Lock()
+	cancel := c.inflight[id]
+	r := c.unqueueLocked(id)
+	c.mu.Unlock()
+	if r != nil {
+		// The request never started, and nobody waits for its answer.
+		c.returnCredit(c.credit.release(r.held))
+		c.finishRequest(id, r.cancel)
 		return
 	}
+	if cancel != nil {
+		cancel()
+	}
+}
+
+func (c *serverConn) finishRequest(id uint64, cancel context.CancelFunc) {
+	c.mu.Lock()
+	delete(c.inflight, id)
+	delete(c.streams, id)
+	c.mu.Unlock()
+	c.window.forget(id)
+	c.credit.forget(id)
+	cancel()
+}
 
-	args, err = codec.ReadRequestBody()
-	if req.Checksum != crc32.ChecksumIEEE(args) {
-		err = fmt.Errorf("request checksum mismatch")
+// startStream registers the stream opened by the request with the given id,
+// so that the messages of the client reach it.
+func (c *serverConn) startStream(ctx context.Context, id uint64) *serverStream {
+	stream := newServerStream(c, ctx, id)
+	c.mu.Lock()
+	c.streams[id] = stream
+	c.mu.Unlock()
+	return stream
+}
+
+// deliver hands a message or close-send of the client to its stream. err
+// reports a message that failed its checksum.
+func (c *serverConn) deliver(req *RequestHeader, body []byte, size int, err error) {
+	c.mu.Lock()
+	stream := c.streams[req.ID]
+	c.mu.Unlock()
+	if stream == nil {
+		// The stream has already ended.
+		return
+	}
+
+	switch {
+	case err != nil:
+		stream.recv.close(err)
+	case req.Type == RequestCloseSend:
+		stream.recv.close(io.EOF)
+	default:
+		stream.recv.push(body, size)
 	}
-	return
 }
 
-func (s *Server) call(req *RequestHeader, codec ServerCodec, handler Handler, args []byte) error {
-	resp := new(ResponseHeader)
-	reply, err := handler(args)
+func (c *serverConn) startDraining() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.draining = true
+}
+
+// setIdle records whether serve waits for a request with none partly read,
+// so that closeIfIdle doesn't cut off a request serve is still handling. For
+// connections served by ServeConn, the first byte that arrives clears it.
+func (c *serverConn) setIdle(idle bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.idle = idle
+}
+
+// closeIfIdle closes the connection if no request is in flight or being read
+// and reports whether the connection is closed.
+func (c *serverConn) closeIfIdle() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.inflight) > 0 || !c.idle && !c.closed {
+		return false
+	}
+	c.closeLocked()
+	return true
+}
 
-	resp.ID = req.ID
+func (c *serverConn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeLocked()
+}
+
+func (c *serverConn) closeLocked() {
+	if !c.closed {
+		c.closed = true
+		c.codec.Close()
+		c.cancel()
+	}
+}
+
+func (c *serverConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// waitingRequest is a request that was read and registered, and runs once
+// it has a handler slot.
+type waitingRequest struct {
+	id     uint64
+	cancel context.CancelFunc
+	run    func() // runs the handler and releases the slot
+	held   int    // connection credit held back while the request waits
+}
+
+// maxWaitingRequests is how many requests of a connection may wait for a
+// handler slot. Their bodies are bounded by the connection window they hold
+// back, but requests with small bodies need a limit of their own.
+const maxWaitingRequests = 1000
+
+// errQueueFull answers the requests that arrive while maxWaitingRequests
+// others already wait for a handler slot.
+var errQueueFull = NewError(ResourceExhausted, "too many requests waiting for a handler")
+
+// admit runs r if one of the maxConcurrent handler slots is free, and
+// otherwise queues it without a goroutine until one is. A queued request
+// holds back the connection credit of its body, so that the client can't
+// pile up bodies the server keeps, while the frames of the running requests
+// still get through. Once maxWaitingRequests are queued, further ones fail
+// with errQueueFull.
+func (c *serverConn) admit(r *waitingRequest) error {
+	c.mu.Lock()
+	switch {
+	case c.running < c.server.opts.maxConcurrent:
+		c.running++
+		c.mu.Unlock()
+		c.start(r)
+		return nil
+	case len(c.queue) >= maxWaitingRequests:
+		c.mu.Unlock()
+		return errQueueFull
+	}
+	c.queue = append(c.queue, r)
+	c.credit.withhold(r.held)
+	c.mu.Unlock()
+	return nil
+}
+
+// start runs r, which holds a handler slot, in its own goroutine.
+func (c *serverConn) start(r *waitingRequest) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer c.finishRequest(r.id, r.cancel)
+		r.run()
+	}()
+}
+
+// release hands the handler slot of a request whose handler returned to the
+// first queued request, if any.
+func (c *serverConn) release() {
+	c.mu.Lock()
+	if len(c.queue) == 0 {
+		c.running--
+		c.mu.Unlock()
+		return
+	}
+	r := c.queue[0]
+	c.queue[0] = nil
+	c.queue = c.queue[1:]
+	c.mu.Unlock()
+	c.returnCredit(c.credit.release(r.held))
+	c.start(r)
+}
+
+// unqueueLocked removes the request with the given id from the queue and
+// returns it, or nil if it isn't queued.
+func (c *serverConn) unqueueLocked(id uint64) *waitingRequest {
+	for i, r := range c.queue {
+		if r.id == id {
+			c.queue = append(c.queue[:i], c.queue[i+1:]...)
+			return r
+		}
+	}
+	return nil
+}
+
+// call runs a unary handler. size is the part of args whose credit is
+// returned once the handler starts.
+func (c *serverConn) call(ctx context.Context, req *RequestHeader, handler ContextHandler, args []byte, size int) {
+	var reply []byte
+	c.consumed(req.ID, size)
+	// The request may have been cancelled while it waited for a slot.
+	err := ctx.Err()
+	if err == nil {
+		err = c.protect(req.Method, func() (err error) {
+			reply, err = c.server.invoke(ctx, req, handler, args)
+			return err
+		})
+	}
+	c.release()
+
+	md := ctx.Value(responseMetadataKey{}).(*responseMetadata).get()
+	c.reply(ctx, req.ID, md, reply, err)
+}
+
+func (c *serverConn) runStream(method string, stream *serverStream, handler func(*serverStream) error) {
+	err := stream.ctx.Err()
+	if err == nil {
+		err = c.protect(method, func() error {
+			return handler(stream)
+		})
+	}
+	c.release()
+
+	md := stream.ctx.Value(responseMetadataKey{}).(*responseMetadata).get()
+	stream.end(md, err)
+}
+
+// protect runs fn, the handler of a request to method. If it panics, the
+// panic is logged and reported to the panic hook, and the request fails with
+// an Internal error instead of taking the process down.
+func (c *serverConn) protect(method string, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.server.opts.logger.Log(LevelError, "rpc:handler panicked",
+				"method", method, "panic", r, "stack", string(debug.Stack()))
+			if c.server.opts.panicHook != nil {
+				c.server.opts.panicHook(method, r)
+			}
+			err = Errorf(Internal, "panic serving %s", method)
+		}
+	}()
+	return fn()
+}
+
+// reject answers req with err without running a handler.
+func (c *serverConn) reject(req *RequestHeader, err error) {
+	if req.Type == RequestStream {
+		resp := &ResponseHeader{
+			Type:     ResponseEnd,
+			ID:       req.ID,
+			Checksum: crc32.ChecksumIEEE(nil),
+		}
+		resp.SetErr(err)
+		c.writeResponse(resp, nil)
+		return
+	}
+	c.reply(c.ctx, req.ID, nil, nil, err)
+}
+
+// invoke runs handler behind the server's interceptors.
+func (s *Server) invoke(ctx context.Context, req *RequestHeader, handler ContextHandler, args []byte) ([]byte, error) {
+	if len(s.opts.interceptors) == 0 {
+		return handler(ctx, args)
+	}
+	info := &UnaryServerInfo{
+		FullMethod: req.Method,
+		Header:     req,
+	}
+	return chainUnaryServer(s.opts.interceptors, info, handler)(ctx, args)
+}
+
+// reply writes the response to the unary request with the given id. The
+// reply is abandoned if ctx is done before it is sent.
+func (c *serverConn) reply(ctx context.Context, id uint64, md Metadata, reply []byte, err error) {
+	resp := new(ResponseHeader)
+	resp.Type = ResponseReply
+	resp.ID = id
+	resp.Metadata = md
 	if err != nil {
-		resp.Error = err.Error()
+		resp.SetErr(err)
+		reply = nil
 	}
-	resp.Checksum = crc32.ChecksumIEEE(reply)
-	if err := codec.WriteResponse(resp, reply); err != nil {
-		log.Printf("rpc:failed to send response, err:%s", err)
+	if err := c.writeMessage(ctx, resp, reply); err != nil && ctx.Err() != nil {
+		// Send the status instead, which also tells the client to drop
+		// the fragments it got.
+		resp = &ResponseHeader{
+			Type:     ResponseReply,
+			ID:       id,
+			Checksum: crc32.ChecksumIEEE(nil),
+		}
+		resp.SetErr(ctx.Err())
+		c.writeResponse(resp, nil)
+	}
+}
+
+// writeMessage writes resp followed by body, split into fragments of at most
+// MaxFragmentSize as far as the send window allows. The sending lock is only
+// held per fragment, so other responses can be sent in between.
+func (c *serverConn) writeMessage(ctx context.Context, resp *ResponseHeader, body []byte) error {
+	for {
+		size := len(body)
+		if size > MaxFragmentSize {
+			size = MaxFragmentSize
+		}
+		n, err := c.window.reserve(ctx, resp.ID, size)
+		if err != nil {
+			return err
+		}
+		fragment := body[:n]
+		body = body[n:]
+		if len(body) > 0 {
+			resp.Flags |= FlagMore
+		} else {
+			resp.Flags &^= FlagMore
+		}
+		resp.Checksum = crc32.ChecksumIEEE(fragment)
+
+		if err := c.writeResponse(resp, fragment); err != nil {
+			return err
+		}
+		if len(body) == 0 {
+			return nil
+		}
+		resp = &ResponseHeader{
+			Type: ResponseContinuation,
+			ID:   resp.ID,
+		}
+	}
+}
+
+// consumed returns the credit for n bytes of the request with the given id
+// once they were consumed.
+func (c *serverConn) consumed(id uint64, n int) {
+	c.returnCredit(c.credit.consumed(id, n))
+}
+
+// returnCredit sends updates to the client. It doesn't wait for the sending
+// lock, as it is called by serve.
+func (c *serverConn) returnCredit(updates []windowUpdate) {
+	if len(updates) > 0 {
+		go c.sendWindowUpdates(updates)
+	}
+}
+
+func (c *serverConn) sendWindowUpdates(updates []windowUpdate) {
+	for _, u := range updates {
+		body := encodeWindowUpdate(u.n)
+		resp := &ResponseHeader{
+			Type:     ResponseWindowUpdate,
+			ID:       u.id,
+			Checksum: crc32.ChecksumIEEE(body),
+		}
+		if err := c.writeResponse(resp, body); err != nil {
+			return
+		}
+	}
+}
+
+func (c *serverConn) writeResponse(resp *ResponseHeader, body []byte) error {
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	if err := c.codec.WriteResponse(resp, body); err != nil {
+		c.server.opts.logger.Log(LevelDebug, "rpc:failed to send response", "err", err)
+		// The connection is broken, stop reading from it as well.
+		c.codec.Close()
 		return err
 	}
 	return nil
 }
 
 func RegisterService(s *Server, serviceMethodName string, method Handler) error {
+	return RegisterServiceContext(s, serviceMethodName, func(_ context.Context, args []byte) ([]byte, error) {
+		return method(args)
+	})
+}
+
+// RegisterServiceContext is like RegisterService, but for handlers that take
+// the request context.
+func RegisterServiceContext(s *Server, serviceMethodName string, handler ContextHandler) error {
+	return registerMethod(s, serviceMethodName, &method{unary: handler})
+}
+
+func registerMethod(s *Server, serviceMethodName string, m *method) error {
 	dot := strings.LastIndex(serviceMethodName, ".")
 	if dot == -1 {
-		log.Println("serviceMethod bust be the format of serviceName.methodName")
 		return fmt.Errorf("serviceMethod bust be the format of serviceName.methodName")
 	}
 	serviceName := serviceMethodName[:dot]
@@ -134,12 +995,9 @@ func RegisterService(s *Server, serviceMethodName string, method Handler) error
 	svc := svci.(*service)
 
 	if _, ok := svc.methodMap[methodName]; ok {
-		log.Printf("rpc:%s has been registered", serviceMethodName)
 		return fmt.Errorf("%s has been registered", serviceMethodName)
 	}
-	svc.methodMap[methodName] = method
-	log.Printf("rpc:register %s successfully", serviceMethodName)
-
+	svc.methodMap[methodName] = m
 	return nil
 }
 
@@ -150,45 +1008,102 @@ type ServerCodec interface {
 	Close() error
 }
 
+// buffered reports whether codec holds bytes it has read from its conn but
+// not returned yet, as far as it tells.
+func buffered(codec ServerCodec) bool {
+	b, ok := codec.(interface{ buffered() int })
+	return ok && b.buffered() > 0
+}
+
+// notifyConn is the conn of a connection served by ServeConn. It calls
+// onRead whenever bytes arrive.
+type notifyConn struct {
+	net.Conn
+	onRead func()
+}
+
+func (c *notifyConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && c.onRead != nil {
+		c.onRead()
+	}
+	return n, err
+}
+
 type serverCodec struct {
-	r io.Reader
-	w io.Writer
-	c io.Closer
+	r      io.Reader
+	w      io.Writer
+	c      io.Closer
+	limits Limits
 
+	mu     sync.Mutex // protects closed
 	closed bool
+
+	gotPreface bool     // guarded by the reader
+	features   Features // negotiated with the client
 }
 
+// NewServerCodec returns a ServerCodec for conn with DefaultLimits.
 func NewServerCodec(conn io.ReadWriteCloser) ServerCodec {
+	return newServerCodec(conn, DefaultLimits)
+}
+
+func newServerCodec(conn io.ReadWriteCloser, limits Limits) *serverCodec {
 	return &serverCodec{
-		r: bufio.NewReader(conn),
-		w: bufio.NewWriter(conn),
-		c: conn,
+		r:      bufio.NewReader(conn),
+		w:      bufio.NewWriter(conn),
+		c:      conn,
+		limits: limits,
 	}
 }
 
+func (s *serverCodec) buffered() int {
+	return s.r.(*bufio.Reader).Buffered()
+}
+
 func (s *serverCodec) ReadRequestHeader(r *RequestHeader) error {
-	data, err := recvFrame(s.r)
-	if err != nil {
-		if err != io.EOF {
-			log.Printf("rpc:failed to receive request header, err is %s", err)
+	if !s.gotPreface {
+		if err := s.handshake(); err != nil {
+			return err
 		}
+	}
+
+	data, err := recvFrame(s.r, s.limits.MaxHeaderSize)
+	if err != nil {
 		return err
 	}
 
 	return r.Unmarshal(data)
 }
 
+// handshake sends the server preface and checks the client's. Nothing else
+// is written before the first request is read, so it needn't lock the writer.
+func (s *serverCodec) handshake() error {
+	if err := writePreface(s.w, localPreface()); err != nil {
+		return err
+	}
+	if err := s.w.(*bufio.Writer).Flush(); err != nil {
+		return err
+	}
+
+	p, err := readPreface(s.r)
+	if err != nil {
+		return err
+	}
+	s.features = p.Features & supportedFeatures
+	s.gotPreface = true
+	return nil
+}
+
 func (s *serverCodec) ReadRequestBody() ([]byte, error) {
-	return recvFrame(s.r)
+	return recvFrame(s.r, s.limits.MaxBodySize)
 }
 
 func (s *serverCodec) WriteResponse(resp *ResponseHeader, body []byte) error {
 	if err := sendFrame(s.w, resp.Marshal()); err != nil {
-		log.Printf("rpc:failed to send request header, err is %s", err)
 		return err
 	}
 	if err := sendFrame(s.w, body); err != nil {
-		log.Printf("rpc:failed to send request body, err is %s", err)
 		return err
 	}
 
@@ -196,6 +1111,8 @@ func (s *serverCodec) WriteResponse(resp *ResponseHeader, body []byte) error {
 }
 
 func (s *serverCodec) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.closed {
 		return nil
 	}
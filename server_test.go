@@ -1,10 +1,19 @@
 package drpc
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
 	"math/rand"
 	"net"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 
@@ -166,3 +175,687 @@ func TestConcurrentMath(t *testing.T) {
 		})
 	}
 }
+
+// startBlockingServer starts a server whose "Block.Wait" method blocks until
+// its context is done and then reports the context error on the returned
+// channel.
+func startBlockingServer(t *testing.T) (string, <-chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	server := NewServer()
+	RegisterServiceContext(server, "Block.Wait", func(ctx context.Context, req []byte) ([]byte, error) {
+		if _, ok := ctx.Deadline(); !ok && string(req) == "deadline" {
+			done <- errors.New("request has no deadline")
+			return nil, nil
+		}
+
+		<-ctx.Done()
+		done <- ctx.Err()
+		return nil, ctx.Err()
+	})
+	go server.Serve(listener)
+	return listener.Addr().String(), done
+}
+
+type rawArgs []byte
+
+func (r *rawArgs) Marshal() ([]byte, error) {
+	return *r, nil
+}
+
+func (r *rawArgs) Unmarshal(data []byte) error {
+	*r = data
+	return nil
+}
+
+func TestHandlerContextCancel(t *testing.T) {
+	addr, done := startBlockingServer(t)
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	call := client.GoContext(ctx, "Block.Wait", new(rawArgs), new(rawArgs))
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	<-call.Done
+
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("handler was not cancelled")
+	}
+}
+
+func TestHandlerContextDeadline(t *testing.T) {
+	addr, done := startBlockingServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec := NewClientCodec(conn)
+	defer codec.Close()
+
+	// Talk to the server directly so that only the server enforces the deadline.
+	body := []byte("deadline")
+	req := &RequestHeader{
+		ID:       1,
+		Method:   "Block.Wait",
+		Timeout:  20 * time.Millisecond,
+		Checksum: crc32.ChecksumIEEE(body),
+	}
+	assert.NoError(t, codec.WriteRequest(req, body))
+
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(time.Second):
+		t.Fatal("handler did not see the deadline")
+	}
+
+	resp := new(ResponseHeader)
+	assert.NoError(t, codec.ReadResponseHeader(resp))
+	assert.Equal(t, uint64(1), resp.ID)
+	assert.Equal(t, DeadlineExceeded, resp.Code)
+}
+
+func TestDeadlineErrorMatchesContext(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer()
+	// Reply the way the server does when it sees a deadline pass first.
+	RegisterServiceContext(server, "Ctx.Expired", func(ctx context.Context, req []byte) ([]byte, error) {
+		return nil, context.DeadlineExceeded
+	})
+	RegisterServiceContext(server, "Ctx.Canceled", func(ctx context.Context, req []byte) ([]byte, error) {
+		return nil, context.Canceled
+	})
+	go server.Serve(listener)
+	defer server.Close()
+
+	client, err := Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	err = client.Call("Ctx.Expired", new(rawArgs), new(rawArgs))
+	assert.Equal(t, DeadlineExceeded, CodeOf(err))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.NotErrorIs(t, err, context.Canceled)
+
+	err = client.Call("Ctx.Canceled", new(rawArgs), new(rawArgs))
+	assert.Equal(t, Canceled, CodeOf(err))
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// The client noticing first gives an error that matches the same way.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+	err = client.CallContext(ctx, "Ctx.Expired", new(rawArgs), new(rawArgs))
+	assert.Equal(t, DeadlineExceeded, CodeOf(err))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestHandlerContextConnectionDrop(t *testing.T) {
+	addr, done := startBlockingServer(t)
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.Go("Block.Wait", new(rawArgs), new(rawArgs))
+	time.Sleep(10 * time.Millisecond)
+	client.Close()
+
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("handler was not cancelled when the connection dropped")
+	}
+}
+
+func TestConcurrentDispatch(t *testing.T) {
+	client, err := Dial("tcp", startSleepServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	slow := client.Go("Sleep.Sleep", &mathArgs{A: 300}, new(mathReply))
+	fast := client.Go("Sleep.Sleep", &mathArgs{A: 1}, new(mathReply))
+
+	select {
+	case <-fast.Done:
+		assert.NoError(t, fast.Error)
+	case <-slow.Done:
+		t.Fatal("slow call blocked the fast one")
+	}
+	<-slow.Done
+	assert.NoError(t, slow.Error)
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	server := NewServer(WithMaxConcurrentRequests(1))
+	client, err := Dial("tcp", serveSleep(t, server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	slow := client.Go("Sleep.Sleep", &mathArgs{A: 100}, new(mathReply))
+	time.Sleep(10 * time.Millisecond)
+	fast := client.Go("Sleep.Sleep", &mathArgs{A: 1}, new(mathReply))
+
+	select {
+	case <-fast.Done:
+		t.Fatal("fast call ran while the only slot was taken")
+	case <-slow.Done:
+	}
+	<-fast.Done
+	assert.NoError(t, fast.Error)
+}
+
+func TestMaxConcurrentRequestsBoundsGoroutines(t *testing.T) {
+	server := NewServer(WithMaxConcurrentRequests(2))
+	conn, err := net.Dial("tcp", serveSleep(t, server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec := NewClientCodec(conn)
+	defer codec.Close()
+
+	send := func(id uint64, ms int) {
+		body, _ := (&mathArgs{A: ms}).Marshal()
+		req := &RequestHeader{ID: id, Method: "Sleep.Sleep", Checksum: crc32.ChecksumIEEE(body)}
+		assert.NoError(t, codec.WriteRequest(req, body))
+	}
+	// Once a call went through, the connection is being served.
+	send(1, 1)
+	assert.NoError(t, codec.ReadResponseHeader(new(ResponseHeader)))
+	_, err = codec.ReadResponseBody()
+	assert.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	before := runtime.NumGoroutine()
+
+	for id := uint64(2); id < 50; id++ {
+		send(id, 100)
+	}
+	time.Sleep(50 * time.Millisecond)
+	// Two handlers run; the other requests wait without a goroutine.
+	assert.LessOrEqual(t, runtime.NumGoroutine()-before, 2+2)
+}
+
+func TestShutdown(t *testing.T) {
+	server := NewServer()
+	client, err := Dial("tcp", serveSleep(t, server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	inflight := client.Go("Sleep.Sleep", &mathArgs{A: 100}, new(mathReply))
+	time.Sleep(10 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	err = client.Call("Sleep.Sleep", &mathArgs{A: 1}, new(mathReply))
+	assert.ErrorIs(t, err, ErrServerDraining)
+	assert.Equal(t, Unavailable, CodeOf(err))
+
+	<-inflight.Done
+	assert.NoError(t, inflight.Error)
+	assert.NoError(t, <-shutdown)
+
+	err = client.Call("Sleep.Sleep", &mathArgs{A: 1}, new(mathReply))
+	assert.Error(t, err)
+}
+
+func TestShutdownWaitsForPartlyReadRequest(t *testing.T) {
+	server := NewServer()
+	conn, err := net.Dial("tcp", serveSleep(t, server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec := NewClientCodec(conn)
+	defer codec.Close()
+
+	body, _ := (&mathArgs{A: 1}).Marshal()
+	first, rest := body[:len(body)/2], body[len(body)/2:]
+	req := &RequestHeader{ID: 1, Flags: FlagMore, Method: "Sleep.Sleep", Checksum: crc32.ChecksumIEEE(first)}
+	assert.NoError(t, codec.WriteRequest(req, first))
+	time.Sleep(10 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown closed a connection with a request partly read")
+	default:
+	}
+
+	// The request is answered instead of cut off.
+	req = &RequestHeader{Type: RequestContinuation, ID: 1, Checksum: crc32.ChecksumIEEE(rest)}
+	assert.NoError(t, codec.WriteRequest(req, rest))
+	resp := new(ResponseHeader)
+	assert.NoError(t, codec.ReadResponseHeader(resp))
+	assert.Equal(t, uint64(1), resp.ID)
+	assert.Equal(t, Unavailable, resp.Code)
+	assert.NoError(t, <-shutdown)
+}
+
+// bufferConn is a conn that collects what is written to it.
+type bufferConn struct {
+	bytes.Buffer
+}
+
+func (*bufferConn) Close() error { return nil }
+
+func TestShutdownWaitsForRequestBeingRead(t *testing.T) {
+	server := NewServer()
+	conn, err := net.Dial("tcp", serveSleep(t, server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec := NewClientCodec(conn)
+	defer codec.Close()
+
+	// A first call gets the prefaces out of the way.
+	body, _ := (&mathArgs{A: 1}).Marshal()
+	req := &RequestHeader{ID: 1, Method: "Sleep.Sleep", Checksum: crc32.ChecksumIEEE(body)}
+	assert.NoError(t, codec.WriteRequest(req, body))
+	resp := new(ResponseHeader)
+	assert.NoError(t, codec.ReadResponseHeader(resp))
+	_, err = codec.ReadResponseBody()
+	assert.NoError(t, err)
+
+	// The second arrives in two parts, with Shutdown in between.
+	var frames bufferConn
+	encoder := newClientCodec(&frames, DefaultLimits)
+	encoder.sentPreface = true
+	req = &RequestHeader{ID: 2, Method: "Sleep.Sleep", Checksum: crc32.ChecksumIEEE(body)}
+	assert.NoError(t, encoder.WriteRequest(req, body))
+	data := frames.Bytes()
+	_, err = conn.Write(data[:3])
+	assert.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown closed a connection with a request being read")
+	default:
+	}
+
+	_, err = conn.Write(data[3:])
+	assert.NoError(t, err)
+	assert.NoError(t, codec.ReadResponseHeader(resp))
+	assert.Equal(t, uint64(2), resp.ID)
+	assert.Equal(t, Unavailable, resp.Code)
+	assert.NoError(t, <-shutdown)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	server := NewServer()
+	client, err := Dial("tcp", serveSleep(t, server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	inflight := client.Go("Sleep.Sleep", &mathArgs{A: 200}, new(mathReply))
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, server.Shutdown(ctx), context.DeadlineExceeded)
+
+	assert.NoError(t, server.Close())
+	<-inflight.Done
+	assert.Error(t, inflight.Error)
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary error" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyListener fails Accept with temporary errors a few times and then with
+// a permanent one.
+type flakyListener struct {
+	net.Listener
+	temporary int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.temporary > 0 {
+		l.temporary--
+		return nil, temporaryError{}
+	}
+	return nil, net.ErrClosed
+}
+
+func TestServeTemporaryErrors(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	start := time.Now()
+	err = NewServer().Serve(&flakyListener{Listener: listener, temporary: 3})
+	assert.ErrorIs(t, err, net.ErrClosed)
+	assert.GreaterOrEqual(t, time.Since(start), minAcceptDelay*7)
+}
+
+func TestServeReturnsErrServerClosed(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer()
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	assert.NoError(t, server.Shutdown(context.Background()))
+	assert.ErrorIs(t, <-served, ErrServerClosed)
+	assert.ErrorIs(t, server.Serve(listener), ErrServerClosed)
+}
+
+func TestUnaryServerInterceptors(t *testing.T) {
+	var mu sync.Mutex
+	var trace []string
+	record := func(name string) UnaryServerInterceptor {
+		return func(ctx context.Context, args []byte, info *UnaryServerInfo, handler ContextHandler) ([]byte, error) {
+			mu.Lock()
+			trace = append(trace, name+":"+info.FullMethod)
+			mu.Unlock()
+			return handler(ctx, args)
+		}
+	}
+	deny := func(ctx context.Context, args []byte, info *UnaryServerInfo, handler ContextHandler) ([]byte, error) {
+		req := new(mathArgs)
+		if err := req.Unmarshal(args); err != nil || req.A < 0 {
+			return nil, NewError(PermissionDenied, "permission denied")
+		}
+		return handler(ctx, args)
+	}
+	double := func(ctx context.Context, args []byte, info *UnaryServerInfo, handler ContextHandler) ([]byte, error) {
+		data, err := handler(ctx, args)
+		if err != nil {
+			return nil, err
+		}
+		reply := new(mathReply)
+		if err := reply.Unmarshal(data); err != nil {
+			return nil, err
+		}
+		reply.C *= 2
+		return reply.Marshal()
+	}
+
+	server := NewServer(WithServerInterceptors(record("first"), record("second"), deny, double))
+	client, err := Dial("tcp", serveSleep(t, server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	reply := new(mathReply)
+	assert.NoError(t, client.Call("Sleep.Sleep", &mathArgs{A: 3}, reply))
+	assert.Equal(t, 6, reply.C)
+	assert.Equal(t, []string{"first:Sleep.Sleep", "second:Sleep.Sleep"}, trace)
+
+	err = client.Call("Sleep.Sleep", &mathArgs{A: -1}, new(mathReply))
+	assert.Equal(t, NewError(PermissionDenied, "permission denied"), err)
+}
+
+func TestMetadata(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer()
+	RegisterServiceContext(server, "Echo.Metadata", func(ctx context.Context, req []byte) ([]byte, error) {
+		md := IncomingMetadata(ctx)
+		SetResponseMetadata(ctx, "trace-id", md.Get("trace-id"))
+		SetResponseMetadata(ctx, "server-timing", "1ms")
+		return []byte(md.Get("tenant")), nil
+	})
+	go server.Serve(listener)
+
+	client, err := Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var md Metadata
+	ctx := NewOutgoingContext(context.Background(), Metadata{"trace-id": "abc"})
+	ctx = AppendToOutgoingContext(ctx, "tenant", "acme")
+	ctx = CaptureResponseMetadata(ctx, &md)
+	reply := new(rawArgs)
+	assert.NoError(t, client.CallContext(ctx, "Echo.Metadata", new(rawArgs), reply))
+	assert.Equal(t, "acme", string(*reply))
+	assert.Equal(t, Metadata{"trace-id": "abc", "server-timing": "1ms"}, md)
+
+	call := <-client.Go("Echo.Metadata", new(rawArgs), new(rawArgs)).Done
+	assert.NoError(t, call.Error)
+	assert.Equal(t, Metadata{"trace-id": "", "server-timing": "1ms"}, call.Metadata)
+}
+
+func TestRejectNonDrpcClient(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go NewServer().Serve(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	assert.NoError(t, err)
+
+	// The server answers with its own preface and hangs up.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	p, err := readPreface(bufio.NewReader(conn))
+	assert.NoError(t, err)
+	assert.Equal(t, localPreface(), p)
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestVersionMismatch(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		writePreface(conn, preface{Version: ProtocolVersion + 1})
+		io.Copy(io.Discard, conn)
+	}()
+
+	client, err := Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	err = client.Call("Math.Add", &mathArgs{}, new(mathReply))
+	assert.ErrorIs(t, err, ErrVersionMismatch)
+}
+
+func TestStructuredError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer()
+	RegisterService(server, "Check.Args", func(req []byte) ([]byte, error) {
+		return nil, Errorf(InvalidArgument, "field %s is required", "name").
+			WithDetails(Detail{Type: "field", Value: []byte("name")})
+	})
+	go server.Serve(listener)
+
+	client, err := Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	err = client.Call("Check.Args", new(rawArgs), new(rawArgs))
+	var e *Error
+	if assert.ErrorAs(t, err, &e) {
+		assert.Equal(t, InvalidArgument, e.Code)
+		assert.Equal(t, "field name is required", e.Message)
+		value, ok := e.Detail("field")
+		assert.True(t, ok)
+		assert.Equal(t, "name", string(value))
+	}
+	assert.Equal(t, "rpc error: code = InvalidArgument desc = field name is required", err.Error())
+
+	assert.Equal(t, OK, CodeOf(nil))
+	assert.Equal(t, Canceled, CodeOf(context.Canceled))
+	assert.Equal(t, DeadlineExceeded, CodeOf(fmt.Errorf("wrapped: %w", context.DeadlineExceeded)))
+	assert.Equal(t, Unknown, CodeOf(errors.New("boom")))
+}
+
+func TestUnknownMethodKeepsConnection(t *testing.T) {
+	client, err := Dial("tcp", startSleepServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	inflight := client.Go("Sleep.Sleep", &mathArgs{A: 50}, new(mathReply))
+	for _, method := range []string{"Sleep.Missing", "Missing.Sleep", "Sleep"} {
+		err = client.Call(method, &mathArgs{A: 1}, new(mathReply))
+		assert.Equal(t, NotFound, CodeOf(err), method)
+	}
+	<-inflight.Done
+	assert.NoError(t, inflight.Error)
+
+	reply := new(mathReply)
+	assert.NoError(t, client.Call("Sleep.Sleep", &mathArgs{A: 1}, reply))
+	assert.Equal(t, 1, reply.C)
+}
+
+func TestChecksumMismatchKeepsConnection(t *testing.T) {
+	conn, err := net.Dial("tcp", startSleepServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec := NewClientCodec(conn)
+	defer codec.Close()
+
+	body, _ := (&mathArgs{A: 1}).Marshal()
+	req := &RequestHeader{ID: 1, Method: "Sleep.Sleep", Checksum: crc32.ChecksumIEEE(body) + 1}
+	assert.NoError(t, codec.WriteRequest(req, body))
+	resp := new(ResponseHeader)
+	assert.NoError(t, codec.ReadResponseHeader(resp))
+	_, err = codec.ReadResponseBody()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), resp.ID)
+	assert.Equal(t, DataLoss, resp.Code)
+
+	req = &RequestHeader{ID: 2, Method: "Sleep.Sleep", Checksum: crc32.ChecksumIEEE(body)}
+	assert.NoError(t, codec.WriteRequest(req, body))
+	assert.NoError(t, codec.ReadResponseHeader(resp))
+	assert.Equal(t, uint64(2), resp.ID)
+	assert.Equal(t, OK, resp.Code)
+}
+
+func TestHandlerPanic(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	var mu sync.Mutex
+	panics := make(map[string]int)
+	server := NewServer(
+		WithServerLogger(NewSlogLogger(slog.New(slog.NewJSONHandler(&logs, nil)))),
+		WithPanicHook(func(method string, recovered interface{}) {
+			mu.Lock()
+			defer mu.Unlock()
+			panics[method]++
+		}),
+	)
+	RegisterService(server, "Buggy.Unary", func(req []byte) ([]byte, error) {
+		var m map[string]int
+		m["boom"]++
+		return nil, nil
+	})
+	RegisterStreamService(server, "Buggy.Stream", func(stream ServerStream) error {
+		panic("boom")
+	})
+	go server.Serve(listener)
+
+	client, err := Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	err = client.Call("Buggy.Unary", new(rawArgs), new(rawArgs))
+	assert.Equal(t, Internal, CodeOf(err))
+	stream, err := client.NewStream(context.Background(), "Buggy.Stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, Internal, CodeOf(stream.Recv(new(rawArgs))))
+
+	// The server is still up.
+	err = client.Call("Buggy.Unary", new(rawArgs), new(rawArgs))
+	assert.Equal(t, Internal, CodeOf(err))
+
+	mu.Lock()
+	assert.Equal(t, map[string]int{"Buggy.Unary": 2, "Buggy.Stream": 1}, panics)
+	mu.Unlock()
+
+	var entry struct {
+		Level, Msg, Method, Panic, Stack string
+	}
+	for _, line := range bytes.Split(bytes.TrimSpace(logs.Bytes()), []byte("\n")) {
+		assert.NoError(t, json.Unmarshal(line, &entry))
+		if entry.Method == "Buggy.Stream" {
+			break
+		}
+	}
+	assert.Equal(t, "ERROR", entry.Level)
+	assert.Equal(t, "rpc:handler panicked", entry.Msg)
+	assert.Equal(t, "Buggy.Stream", entry.Method)
+	assert.Equal(t, "boom", entry.Panic)
+	assert.Contains(t, entry.Stack, "goroutine")
+}
@@ -0,0 +1,400 @@
+package drpc
+
+import (
+	"context"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+// Stream is a sequence of messages in each direction between a client and a
+// server, multiplexed with other calls on the same connection. Send and Recv
+// may be called from different goroutines, but neither from several at once.
+type Stream interface {
+	// Context returns the context of the stream. On the server it is
+	// cancelled like the context of a unary call.
+	Context() context.Context
+	// Send sends msg to the other side.
+	Send(msg Serializer) error
+	// Recv reads the next message of the other side into msg. It returns
+	// io.EOF once the other side has finished sending.
+	Recv(msg Serializer) error
+}
+
+// ServerStream is the server side of a stream. The server finishes sending
+// by returning from its StreamHandler.
+type ServerStream interface {
+	Stream
+}
+
+var (
+	_ Stream       = (*ClientStream)(nil)
+	_ ServerStream = (*serverStream)(nil)
+)
+
+// StreamHandler handles a streaming method. It can receive and send
+// messages in any order, which covers client-streaming and bidirectional
+// calls. The stream ends when the handler returns; the error it returns
+// becomes the status of the stream.
+type StreamHandler func(stream ServerStream) error
+
+// ServerStreamHandler handles a server-streaming method: it receives the
+// single request of the client in args and sends any number of messages
+// back through stream.
+type ServerStreamHandler func(args []byte, stream ServerStream) error
+
+// RegisterStreamService registers a streaming method.
+func RegisterStreamService(s *Server, serviceMethodName string, handler StreamHandler) error {
+	return registerMethod(s, serviceMethodName, &method{
+		stream: func(stream *serverStream) error {
+			return handler(stream)
+		},
+	})
+}
+
+// RegisterServerStreamService registers a server-streaming method.
+func RegisterServerStreamService(s *Server, serviceMethodName string, handler ServerStreamHandler) error {
+	return registerMethod(s, serviceMethodName, &method{
+		stream: func(stream *serverStream) error {
+			args, err := stream.recv.pop(stream.ctx)
+			if err == io.EOF {
+				return NewError(InvalidArgument, "stream closed before the request was sent")
+			} else if err != nil {
+				return err
+			}
+			return handler(args, stream)
+		},
+	})
+}
+
+// messageQueue buffers the messages a stream has received until they are
+// read. It is safe for one reader and any number of writers.
+type messageQueue struct {
+	mu     sync.Mutex
+	msgs   []queuedMessage
+	err    error         // returned by pop once msgs is drained
+	notify chan struct{} // holds a token when msgs or err changed
+
+	consumed func(n int) // returns the flow control credit of a popped message
+}
+
+type queuedMessage struct {
+	data   []byte
+	credit int
+}
+
+func newMessageQueue(consumed func(n int)) *messageQueue {
+	return &messageQueue{
+		notify:   make(chan struct{}, 1),
+		consumed: consumed,
+	}
+}
+
+func (q *messageQueue) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// push appends msg, unless the queue is closed. Once msg is popped, credit
+// bytes of flow control credit are returned for it.
+func (q *messageQueue) push(msg []byte, credit int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err == nil {
+		q.msgs = append(q.msgs, queuedMessage{msg, credit})
+		q.signal()
+	}
+}
+
+// close makes pop return err once the queued messages are read. Only the
+// first close counts.
+func (q *messageQueue) close(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err == nil {
+		q.err = err
+		q.signal()
+	}
+}
+
+// pop returns the next message, blocking until there is one, the queue is
+// closed, or ctx is done.
+func (q *messageQueue) pop(ctx context.Context) ([]byte, error) {
+	for {
+		q.mu.Lock()
+		if len(q.msgs) > 0 {
+			msg := q.msgs[0]
+			q.msgs[0] = queuedMessage{}
+			q.msgs = q.msgs[1:]
+			q.mu.Unlock()
+			q.consumed(msg.credit)
+			return msg.data, nil
+		}
+		err := q.err
+		q.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case <-q.notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// serverStream is the ServerStream handed to stream handlers.
+type serverStream struct {
+	conn *serverConn
+	ctx  context.Context
+	id   uint64
+	recv *messageQueue
+
+	mu    sync.Mutex // protects ended
+	ended bool       // the handler has returned
+}
+
+func newServerStream(conn *serverConn, ctx context.Context, id uint64) *serverStream {
+	return &serverStream{
+		conn: conn,
+		ctx:  ctx,
+		id:   id,
+		recv: newMessageQueue(func(n int) {
+			conn.consumed(id, n)
+		}),
+	}
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *serverStream) Send(msg Serializer) error {
+	data, err := msg.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return NewError(FailedPrecondition, "send on a finished stream")
+	}
+	resp := &ResponseHeader{
+		Type: ResponseMessage,
+		ID:   s.id,
+	}
+	return s.conn.writeMessage(s.ctx, resp, data)
+}
+
+func (s *serverStream) Recv(msg Serializer) error {
+	data, err := s.recv.pop(s.ctx)
+	if err != nil {
+		return err
+	}
+	return msg.Unmarshal(data)
+}
+
+// end sends the status of the stream. Send fails afterwards.
+func (s *serverStream) end(md Metadata, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ended = true
+
+	resp := &ResponseHeader{
+		Type:     ResponseEnd,
+		ID:       s.id,
+		Metadata: md,
+		Checksum: crc32.ChecksumIEEE(nil),
+	}
+	resp.SetErr(err)
+	s.conn.writeResponse(resp, nil)
+}
+
+// ClientStream is the client side of a stream.
+type ClientStream struct {
+	client *Client
+	ctx    context.Context
+	id     uint64
+	method string
+	recv   *messageQueue
+
+	mu         sync.Mutex // protects sendClosed
+	sendClosed bool
+
+	md       Metadata      // set before recv is closed by the end of the stream
+	finished chan struct{} // closed once the stream ended
+	once     sync.Once
+}
+
+func newClientStream(client *Client, ctx context.Context, method string) *ClientStream {
+	s := &ClientStream{
+		client:   client,
+		ctx:      ctx,
+		method:   method,
+		finished: make(chan struct{}),
+	}
+	s.recv = newMessageQueue(func(n int) {
+		client.consumed(s.id, n)
+	})
+	return s
+}
+
+// CallStream calls a server-streaming method. It sends args and returns a
+// stream to read the replies from.
+func (c *Client) CallStream(ctx context.Context, serviceMethod string, args Serializer) (*ClientStream, error) {
+	s, err := c.NewStream(ctx, serviceMethod)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Send(args); err != nil {
+		c.abortStream(s, err)
+		return nil, err
+	}
+	if err := s.CloseSend(); err != nil {
+		c.abortStream(s, err)
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewStream opens a stream to a streaming method. The stream is abandoned,
+// and the server told to stop, when ctx is done.
+func (c *Client) NewStream(ctx context.Context, serviceMethod string) (*ClientStream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if c.isShutdown() {
+		return nil, ErrShutdown
+	}
+	timeout, err := requestTimeout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s := newClientStream(c, ctx, serviceMethod)
+	req := &RequestHeader{
+		Type:     RequestStream,
+		ID:       c.getSeq(),
+		Method:   serviceMethod,
+		Timeout:  timeout,
+		Metadata: OutgoingMetadata(ctx),
+	}
+	s.id = req.ID
+	c.openWindows(s.id)
+	c.registerStream(s)
+
+	if _, err := c.writeMessage(ctx, req, nil); err != nil {
+		if c.takeStream(s.id) != nil {
+			s.finish(nil, err)
+		}
+		return nil, err
+	}
+	if ctx.Done() != nil {
+		go c.watchStream(s)
+	}
+	return s, nil
+}
+
+// watchStream abandons s when its context is done before it ends.
+func (c *Client) watchStream(s *ClientStream) {
+	select {
+	case <-s.ctx.Done():
+		c.abortStream(s, s.ctx.Err())
+	case <-s.finished:
+	}
+}
+
+// abortStream ends s with err and tells the server to stop, unless s has
+// already ended.
+func (c *Client) abortStream(s *ClientStream, err error) {
+	if c.takeStream(s.id) != nil {
+		s.finish(nil, err)
+		c.sendCancel(s.id)
+	}
+}
+
+// Send sends msg to the server. It returns io.EOF if the stream has already
+// ended; Recv then returns its status.
+func (s *ClientStream) Send(msg Serializer) error {
+	body, err := msg.Marshal()
+	if err != nil {
+		return err
+	}
+	return s.write(&RequestHeader{
+		Type: RequestMessage,
+		ID:   s.id,
+	}, body, false)
+}
+
+// CloseSend tells the server the client won't send any more messages. The
+// stream stays open for receiving.
+func (s *ClientStream) CloseSend() error {
+	return s.write(&RequestHeader{
+		Type: RequestCloseSend,
+		ID:   s.id,
+	}, nil, true)
+}
+
+func (s *ClientStream) write(req *RequestHeader, body []byte, closeSend bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sendClosed {
+		return NewError(FailedPrecondition, "send on a stream after CloseSend")
+	}
+	select {
+	case <-s.finished:
+		return io.EOF
+	default:
+	}
+
+	if _, err := s.client.writeMessage(s.ctx, req, body); err != nil {
+		return err
+	}
+	s.sendClosed = closeSend
+	return nil
+}
+
+// Context returns the context the stream was opened with.
+func (s *ClientStream) Context() context.Context {
+	return s.ctx
+}
+
+// Recv reads the next message of the server into reply. It returns io.EOF
+// once the server ended the stream successfully, the status of the stream
+// as an *Error if it failed, or ctx.Err() if the stream was abandoned.
+func (s *ClientStream) Recv(reply Serializer) error {
+	data, err := s.recv.pop(s.ctx)
+	if err != nil {
+		return err
+	}
+	return reply.Unmarshal(data)
+}
+
+// Metadata returns the metadata the server sent when it ended the stream.
+// It is only valid after Recv returned an error.
+func (s *ClientStream) Metadata() Metadata {
+	select {
+	case <-s.finished:
+		return s.md
+	default:
+		return nil
+	}
+}
+
+// finish ends the stream: Recv returns err once the queued messages are
+// read. It must be called once, by whoever removed s from Client.streams.
+func (s *ClientStream) finish(md Metadata, err error) {
+	s.once.Do(func() {
+		s.client.forgetWindows(s.id)
+		s.md = md
+		s.recv.close(err)
+		close(s.finished)
+	})
+}
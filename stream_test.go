@@ -0,0 +1,279 @@
+package drpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startCountServer starts a server whose "Count.To" method streams the
+// numbers 1 to args.A, failing instead of sending args.B if it is not zero.
+// "Count.Forever" streams until the client goes away and then reports the
+// context error on the returned channel.
+func startCountServer(t *testing.T) (string, <-chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	server := NewServer()
+	RegisterServerStreamService(server, "Count.To", func(req []byte, stream ServerStream) error {
+		args := new(mathArgs)
+		if err := args.Unmarshal(req); err != nil {
+			return err
+		}
+		for i := 1; i <= args.A; i++ {
+			if i == args.B {
+				return Errorf(OutOfRange, "refusing to send %d", i)
+			}
+			if err := stream.Send(&mathReply{C: i}); err != nil {
+				return err
+			}
+		}
+		SetResponseMetadata(stream.Context(), "count", "done")
+		return nil
+	})
+	RegisterServerStreamService(server, "Count.Forever", func(req []byte, stream ServerStream) error {
+		for i := 0; ; i++ {
+			if err := stream.Send(&mathReply{C: i}); err != nil {
+				done <- stream.Context().Err()
+				return err
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+	RegisterService(server, "Count.Unary", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	go server.Serve(listener)
+	return listener.Addr().String(), done
+}
+
+func TestServerStream(t *testing.T) {
+	addr, _ := startCountServer(t)
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	stream, err := client.CallStream(context.Background(), "Count.To", &mathArgs{A: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 100; i++ {
+		reply := new(mathReply)
+		assert.NoError(t, stream.Recv(reply))
+		assert.Equal(t, i, reply.C)
+	}
+	assert.ErrorIs(t, stream.Recv(new(mathReply)), io.EOF)
+	assert.ErrorIs(t, stream.Recv(new(mathReply)), io.EOF)
+	assert.Equal(t, Metadata{"count": "done"}, stream.Metadata())
+}
+
+func TestServerStreamError(t *testing.T) {
+	addr, _ := startCountServer(t)
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	stream, err := client.CallStream(context.Background(), "Count.To", &mathArgs{A: 10, B: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for {
+		err = stream.Recv(new(mathReply))
+		if err != nil {
+			break
+		}
+		n++
+	}
+	assert.Equal(t, 3, n)
+	assert.Equal(t, OutOfRange, CodeOf(err))
+}
+
+func TestServerStreamCancel(t *testing.T) {
+	addr, done := startCountServer(t)
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.CallStream(ctx, "Count.Forever", &mathArgs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, stream.Recv(new(mathReply)))
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("handler was not cancelled")
+	}
+	assert.ErrorIs(t, stream.Recv(new(mathReply)), context.Canceled)
+
+	// Unary calls on the same connection are unaffected.
+	args := rawArgs(`{"A":1}`)
+	assert.NoError(t, client.Call("Count.Unary", &args, new(rawArgs)))
+}
+
+// badArgs fails to marshal.
+type badArgs struct{}
+
+func (badArgs) Marshal() ([]byte, error) { return nil, errors.New("bad args") }
+func (badArgs) Unmarshal([]byte) error   { return nil }
+
+func TestCallStreamSendFails(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(WithMaxConcurrentRequests(1))
+	RegisterServerStreamService(server, "Echo.Once", func(req []byte, stream ServerStream) error {
+		args := rawArgs(req)
+		return stream.Send(&args)
+	})
+	go server.Serve(listener)
+	client, err := Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	_, err = client.CallStream(context.Background(), "Echo.Once", badArgs{})
+	assert.EqualError(t, err, "bad args")
+	client.mu.Lock()
+	assert.Empty(t, client.streams)
+	client.mu.Unlock()
+
+	// The server gave up the stream and its slot.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	args := rawArgs("ping")
+	stream, err := client.CallStream(ctx, "Echo.Once", &args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := new(rawArgs)
+	assert.NoError(t, stream.Recv(reply))
+	assert.Equal(t, "ping", string(*reply))
+}
+
+func TestStreamMethodMismatch(t *testing.T) {
+	addr, _ := startCountServer(t)
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	err = client.Call("Count.To", &mathArgs{A: 1}, new(mathReply))
+	assert.Equal(t, Unimplemented, CodeOf(err))
+
+	stream, err := client.CallStream(context.Background(), "Count.Unary", &mathArgs{A: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, Unimplemented, CodeOf(stream.Recv(new(mathReply))))
+
+	stream, err = client.CallStream(context.Background(), "Count.Missing", &mathArgs{A: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, NotFound, CodeOf(stream.Recv(new(mathReply))))
+}
+
+// startBidiServer starts a server whose "Bidi.Echo" method echoes every
+// message back doubled, and whose "Bidi.Sum" method replies with the sum of
+// all the messages once the client closes its side.
+func startBidiServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer()
+	RegisterStreamService(server, "Bidi.Echo", func(stream ServerStream) error {
+		for {
+			args := new(mathArgs)
+			if err := stream.Recv(args); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err := stream.Send(&mathReply{C: 2 * args.A}); err != nil {
+				return err
+			}
+		}
+	})
+	RegisterStreamService(server, "Bidi.Sum", func(stream ServerStream) error {
+		sum := 0
+		for {
+			args := new(mathArgs)
+			if err := stream.Recv(args); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			sum += args.A
+		}
+		return stream.Send(&mathReply{C: sum})
+	})
+	go server.Serve(listener)
+	return listener.Addr().String()
+}
+
+func TestBidiStream(t *testing.T) {
+	client, err := Dial("tcp", startBidiServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	stream, err := client.NewStream(context.Background(), "Bidi.Echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, stream.Send(&mathArgs{A: i}))
+		reply := new(mathReply)
+		assert.NoError(t, stream.Recv(reply))
+		assert.Equal(t, 2*i, reply.C)
+	}
+	assert.NoError(t, stream.CloseSend())
+	assert.Equal(t, FailedPrecondition, CodeOf(stream.Send(&mathArgs{})))
+	assert.ErrorIs(t, stream.Recv(new(mathReply)), io.EOF)
+}
+
+func TestClientStream(t *testing.T) {
+	client, err := Dial("tcp", startBidiServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	stream, err := client.NewStream(context.Background(), "Bidi.Sum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 100; i++ {
+		assert.NoError(t, stream.Send(&mathArgs{A: i}))
+	}
+	assert.NoError(t, stream.CloseSend())
+
+	reply := new(mathReply)
+	assert.NoError(t, stream.Recv(reply))
+	assert.Equal(t, 5050, reply.C)
+	assert.ErrorIs(t, stream.Recv(new(mathReply)), io.EOF)
+}